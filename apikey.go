@@ -0,0 +1,71 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// API keys that don't reveal themselves in log output
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+)
+
+// replaces the API key wherever it is logged or printed
+const redactedApiKey = "[redacted]"
+
+// variomediaApiKey holds a Variomedia API key. The key can change any record of the
+// customer's account, so it redacts itself whenever it is printed, logged or marshalled;
+// only value() reveals it, for the Authorization header.
+// The key is kept behind a pointer, so even printing structs holding it in unexported
+// fields (where fmt can't call String()) shows an address only.
+type variomediaApiKey struct {
+	key *string
+}
+
+// newVariomediaApiKey wraps the API key read from a secret
+func newVariomediaApiKey(key string) variomediaApiKey {
+	return variomediaApiKey{key: &key}
+}
+
+// value returns the API key itself - never log the result
+func (k variomediaApiKey) value() string {
+	if k.key == nil {
+		return ""
+	}
+	return *k.key
+}
+
+// hash identifies the API key, i.e. as map key, without keeping the key itself
+func (k variomediaApiKey) hash() [sha256.Size]byte {
+	return sha256.Sum256([]byte(k.value()))
+}
+
+// String implements fmt.Stringer
+func (k variomediaApiKey) String() string {
+	return redactedApiKey
+}
+
+// GoString implements fmt.GoStringer, used for "%#v"
+func (k variomediaApiKey) GoString() string {
+	return redactedApiKey
+}
+
+// Format implements fmt.Formatter, so no verb (i.e. "%x") prints the key
+func (k variomediaApiKey) Format(f fmt.State, verb rune) {
+	if verb == 'q' {
+		fmt.Fprintf(f, "%q", redactedApiKey)
+		return
+	}
+	fmt.Fprint(f, redactedApiKey)
+}
+
+// MarshalJSON implements json.Marshaler
+func (k variomediaApiKey) MarshalJSON() ([]byte, error) {
+	return []byte(`"` + redactedApiKey + `"`), nil
+}
+
+// MarshalLog implements logr.Marshaler, used by structured loggers
+func (k variomediaApiKey) MarshalLog() interface{} {
+	return redactedApiKey
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/klog/v2"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+const testApiToken = "s3cr3t-variomedia-token"
+
+func TestVariomediaApiKey_Redacted(t *testing.T) {
+	key := newVariomediaApiKey(testApiToken)
+	assert.Equal(t, testApiToken, key.value())
+
+	holder := struct {
+		key     variomediaApiKey
+		Key     variomediaApiKey
+		Pointer *variomediaApiKey
+	}{key, key, &key}
+	for _, format := range []string{"%v", "%+v", "%#v", "%s", "%q", "%x", "%X"} {
+		assert.NotContains(t, fmt.Sprintf(format, key), testApiToken, format)
+		assert.NotContains(t, fmt.Sprintf(format, holder), testApiToken, format)
+		assert.NotContains(t, fmt.Sprintf(format, &holder), testApiToken, format)
+	}
+
+	data, err := json.Marshal(holder)
+	require.NoError(t, err)
+	assert.NotContains(t, string(data), testApiToken)
+
+	client := NewvariomediaClient(key)
+	assert.NotContains(t, fmt.Sprintf("%+v", client), testApiToken)
+}
+
+// syncBuffer collects log output written concurrently
+type syncBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *syncBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *syncBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+// captureLog redirects all klog output at the highest verbosity into the returned buffer,
+// until the test ends
+func captureLog(t *testing.T) *syncBuffer {
+	flags := flag.NewFlagSet("klog", flag.ContinueOnError)
+	klog.InitFlags(flags)
+	require.NoError(t, flags.Set("v", "10"))
+	require.NoError(t, flags.Set("logtostderr", "false"))
+	require.NoError(t, flags.Set("alsologtostderr", "false"))
+	output := &syncBuffer{}
+	klog.SetOutput(output)
+
+	t.Cleanup(func() {
+		klog.Flush()
+		flags.Set("v", "0")
+		flags.Set("logtostderr", "true")
+		klog.SetOutput(os.Stderr)
+	})
+	return output
+}
+
+// TestApiKeyNotLogged runs challenges with the API key accepted and rejected, and fails if
+// any log line contains the key
+func TestApiKeyNotLogged(t *testing.T) {
+	output := captureLog(t)
+
+	fakeApi := fakevariomedia.NewTest(t, testApiToken)
+
+	solver := newTestSolver(fakeApi, testApiToken)
+	solver.rateLimiters = newApiKeyRateLimiters(defaultApiRateLimit, defaultApiRateBurst)
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	require.NoError(t, solver.Present(ch))
+	require.NoError(t, solver.CleanUp(ch))
+	// without a cached entry, the record is looked up
+	require.NoError(t, solver.CleanUp(ch))
+
+	// the key is rejected after rotation
+	rejected := fakevariomedia.NewTest(t, "another-token")
+	solver.apiBaseUrl = rejected.URL()
+	assert.Error(t, solver.Present(newTestChallenge("example.com.", "_acme-challenge.example.com.", "other-key")))
+
+	klog.Flush()
+	logged := output.String()
+	require.Contains(t, logged, "doRequest() called", "verbose log output was not captured")
+	var leaks []string
+	for _, line := range strings.Split(logged, "\n") {
+		if strings.Contains(line, testApiToken) {
+			leaks = append(leaks, line)
+		}
+	}
+	assert.Empty(t, leaks, "API key was logged")
+}
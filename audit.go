@@ -0,0 +1,359 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// tamper-evident audit log of the DNS records created and deleted by the webhook
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	"gopkg.in/natefinch/lumberjack.v2"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// operations recorded in the audit log
+	auditCreate = "create"
+	auditDelete = "delete"
+	// deletion of an orphaned record by the record sweeper
+	auditSweep = "sweep"
+	// start of a chain without predecessor, i.e. when no audit log file is kept
+	auditStart = "start"
+
+	// prefix of file sinks in the list of audit sinks
+	auditFileSinkPrefix = "file:"
+	// size in megabytes an audit log file is rotated at
+	defaultAuditFileMaxSize = 100
+	// number of rotated audit log files kept
+	defaultAuditFileMaxBackups = 10
+	// how much of an existing audit log file is read to find its last event
+	auditFileTailSize = 64 * 1024
+	// maximum duration of delivering an event to an HTTP sink
+	auditHttpTimeout = 5 * time.Second
+	// number of events waiting for delivery to an HTTP sink, further events are dropped
+	auditHttpQueueSize = 1000
+	// attempts to deliver an event to an HTTP sink
+	auditHttpAttempts = 5
+	// delay before retrying the delivery to an HTTP sink, doubled per attempt
+	auditHttpRetryDelay = time.Second
+)
+
+// auditEvent describes a single change of a TXT record at Variomedia. Each event
+// carries the hash of its predecessor, so removed or altered events break the chain.
+type auditEvent struct {
+	Time           time.Time `json:"time"`
+	Operation      string    `json:"operation"`
+	ChallengeUID   string    `json:"challengeUid"`
+	Namespace      string    `json:"namespace"`
+	Domain         string    `json:"domain"`
+	Entry          string    `json:"entry"`
+	ValueSha256    string    `json:"valueSha256"`
+	RecordUrl      string    `json:"recordUrl,omitempty"`
+	JobId          string    `json:"jobId,omitempty"`
+	Outcome        string    `json:"outcome"`
+	Error          string    `json:"error,omitempty"`
+	LatencySeconds float64   `json:"latencySeconds"`
+	PreviousHash   string    `json:"previousHash,omitempty"`
+	Hash           string    `json:"hash,omitempty"`
+}
+
+// newAuditEvent starts the event of a change about to be made for the challenge. The TXT
+// value itself is not recorded, only its hash.
+func newAuditEvent(operation string, ch *v1alpha1.ChallengeRequest, domain, entry string) auditEvent {
+	return auditEvent{
+		Time:         time.Now().UTC(),
+		Operation:    operation,
+		ChallengeUID: string(ch.UID),
+		Namespace:    ch.ResourceNamespace,
+		Domain:       domain,
+		Entry:        entry,
+		ValueSha256:  auditValueHash(ch.Key),
+	}
+}
+
+// newSweepAuditEvent starts the event of deleting an orphaned record, which belongs to
+// no challenge
+func newSweepAuditEvent(domain, entry, value string) auditEvent {
+	return auditEvent{
+		Time:        time.Now().UTC(),
+		Operation:   auditSweep,
+		Domain:      domain,
+		Entry:       entry,
+		ValueSha256: auditValueHash(value),
+	}
+}
+
+// newChainStartEvent marks the start of a new chain, so a chain without predecessor is
+// not mistaken for one whose beginning was removed
+func newChainStartEvent() auditEvent {
+	return auditEvent{Time: time.Now().UTC(), Operation: auditStart}
+}
+
+// auditValueHash returns the hex-encoded SHA-256 of a TXT value
+func auditValueHash(value string) string {
+	sum := sha256.Sum256([]byte(value))
+	return hex.EncodeToString(sum[:])
+}
+
+// computeHash returns the hex-encoded SHA-256 of the event's JSON encoding without
+// its own hash
+func (e auditEvent) computeHash() (string, error) {
+	e.Hash = ""
+	data, err := json.Marshal(e)
+	if err != nil {
+		return "", err
+	}
+	sum := sha256.Sum256(data)
+	return hex.EncodeToString(sum[:]), nil
+}
+
+// auditSink receives each event as a single line of JSON
+type auditSink struct {
+	name string
+	io.Writer
+}
+
+// auditLog writes the chained events to all of its sinks
+type auditLog struct {
+	sync.Mutex
+	sinks []auditSink
+	// hash of the most recent event, linked to by the next one
+	previousHash string
+}
+
+// newAuditLog creates an audit log continuing the chain after the given event hash,
+// empty for a new chain
+func newAuditLog(previousHash string, sinks ...auditSink) *auditLog {
+	return &auditLog{sinks: sinks, previousHash: previousHash}
+}
+
+// record completes the event with the outcome of the change and writes it to all sinks.
+// The change was made regardless, so failing sinks are logged, but not reported.
+func (a *auditLog) record(event auditEvent, err error) {
+	if a == nil {
+		return
+	}
+	event.LatencySeconds = time.Since(event.Time).Seconds()
+	event.Outcome = outcome(err)
+	if err != nil {
+		event.Error = err.Error()
+	}
+
+	a.Lock()
+	defer a.Unlock()
+	event.PreviousHash = a.previousHash
+	hash, err := event.computeHash()
+	if err != nil {
+		klog.ErrorS(err, "unable to hash audit event", "operation", event.Operation, "domain", event.Domain, "entry", event.Entry)
+		return
+	}
+	event.Hash = hash
+	line, err := json.Marshal(event)
+	if err != nil {
+		klog.ErrorS(err, "unable to encode audit event", "operation", event.Operation, "domain", event.Domain, "entry", event.Entry)
+		return
+	}
+	line = append(line, '\n')
+	for _, sink := range a.sinks {
+		if _, err := sink.Write(line); err != nil {
+			klog.ErrorS(err, "unable to write audit event", "sink", sink.name, "hash", event.Hash)
+		}
+	}
+	a.previousHash = event.Hash
+}
+
+// httpAuditSink posts each event to an HTTP endpoint. Events are queued and delivered
+// in the background, retrying failed deliveries, so an unavailable endpoint neither
+// delays challenges nor - unless it stays unavailable - leaves gaps in the chain.
+type httpAuditSink struct {
+	url    string
+	client *http.Client
+	queue  chan []byte
+	// delay before the first retry
+	retryDelay time.Duration
+}
+
+// newHttpAuditSink creates an HTTP sink delivering its events until stopCh is closed
+func newHttpAuditSink(url string, client *http.Client, stopCh <-chan struct{}) *httpAuditSink {
+	s := &httpAuditSink{
+		url:        url,
+		client:     client,
+		queue:      make(chan []byte, auditHttpQueueSize),
+		retryDelay: auditHttpRetryDelay,
+	}
+	go s.run(stopCh)
+	return s
+}
+
+// Write implements io.Writer, queueing the event for delivery. It fails only if the
+// queue is full.
+func (s *httpAuditSink) Write(line []byte) (int, error) {
+	select {
+	case s.queue <- append([]byte(nil), line...):
+		return len(line), nil
+	default:
+		return 0, fmt.Errorf("audit endpoint has %d events waiting for delivery, dropping event", auditHttpQueueSize)
+	}
+}
+
+// run delivers the queued events in order until stopCh is closed
+func (s *httpAuditSink) run(stopCh <-chan struct{}) {
+	for {
+		select {
+		case <-stopCh:
+			if len(s.queue) > 0 {
+				klog.ErrorS(nil, "webhook is stopping, audit events not delivered", "sink", s.url, "events", len(s.queue))
+			}
+			return
+		case line := <-s.queue:
+			s.deliver(line, stopCh)
+		}
+	}
+}
+
+// deliver posts the event, retrying with increasing delays until the endpoint accepts it
+// or the attempts are used up
+func (s *httpAuditSink) deliver(line []byte, stopCh <-chan struct{}) {
+	delay := s.retryDelay
+	for attempt := 1; ; attempt++ {
+		err := s.post(line)
+		if err == nil {
+			return
+		}
+		if attempt == auditHttpAttempts {
+			klog.ErrorS(err, "unable to deliver audit event, dropping it", "sink", s.url, "attempts", attempt)
+			return
+		}
+		klog.V(2).InfoS("unable to deliver audit event, retrying", "sink", s.url, "attempt", attempt, "error", err.Error())
+		select {
+		case <-stopCh:
+			klog.ErrorS(err, "webhook is stopping, audit event not delivered", "sink", s.url)
+			return
+		case <-time.After(delay):
+		}
+		delay *= 2
+	}
+}
+
+// post sends a single event, failing unless the endpoint accepts it
+func (s *httpAuditSink) post(line []byte) error {
+	res, err := s.client.Post(s.url, "application/json", bytes.NewReader(line))
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+	io.Copy(io.Discard, res.Body)
+	if res.StatusCode < 200 || res.StatusCode > 299 {
+		return fmt.Errorf("audit endpoint responded with HTTP status %s", res.Status)
+	}
+	return nil
+}
+
+// auditLogFromEnv creates the audit log with the sinks from the webhook's environment,
+// nil if none are configured. HTTP sinks deliver their events until stopCh is closed.
+// The chain continues after the last event of the file sinks, if there is one - else,
+// it starts with a "start" event.
+func auditLogFromEnv(stopCh <-chan struct{}) (*auditLog, error) {
+	maxSize, err := positiveIntFromEnv(envAuditFileMaxSize, defaultAuditFileMaxSize)
+	if err != nil {
+		return nil, err
+	}
+	maxBackups, err := positiveIntFromEnv(envAuditFileMaxBackups, defaultAuditFileMaxBackups)
+	if err != nil {
+		return nil, err
+	}
+
+	var sinks []auditSink
+	previousHash := ""
+	for _, value := range strings.Split(os.Getenv(envAuditSinks), ",") {
+		value = strings.TrimSpace(value)
+		switch {
+		case value == "":
+		case value == "stdout":
+			sinks = append(sinks, auditSink{name: value, Writer: os.Stdout})
+		case strings.HasPrefix(value, auditFileSinkPrefix):
+			path := strings.TrimPrefix(value, auditFileSinkPrefix)
+			if path == "" {
+				return nil, fmt.Errorf("invalid %s `%s`: missing file name", envAuditSinks, value)
+			}
+			hash, err := lastAuditHash(path)
+			if err != nil {
+				return nil, err
+			}
+			if previousHash == "" {
+				previousHash = hash
+			} else if hash != "" && hash != previousHash {
+				klog.ErrorS(nil, "audit log files end with different events, continuing the chain of the first one", "file", path)
+			}
+			sinks = append(sinks, auditSink{name: value, Writer: &lumberjack.Logger{
+				Filename:   path,
+				MaxSize:    maxSize,
+				MaxBackups: maxBackups,
+			}})
+		case strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://"):
+			sinks = append(sinks, auditSink{name: value, Writer: newHttpAuditSink(value, &http.Client{Timeout: auditHttpTimeout}, stopCh)})
+		default:
+			return nil, fmt.Errorf("invalid %s `%s`: must be \"stdout\", \"file:<path>\" or an http(s) URL", envAuditSinks, value)
+		}
+	}
+	if len(sinks) == 0 {
+		return nil, nil
+	}
+	audit := newAuditLog(previousHash, sinks...)
+	if previousHash == "" {
+		audit.record(newChainStartEvent(), nil)
+	}
+	return audit, nil
+}
+
+// lastAuditHash returns the hash of the last event in the audit log file, empty if
+// there is none yet. A last line that is no event starts a new chain - the break
+// remains visible in the file.
+func lastAuditHash(path string) (string, error) {
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return "", nil
+	}
+	if err != nil {
+		return "", fmt.Errorf("unable to read audit log file: %v", err)
+	}
+	defer f.Close()
+
+	info, err := f.Stat()
+	if err != nil {
+		return "", fmt.Errorf("unable to read audit log file: %v", err)
+	}
+	offset := info.Size() - auditFileTailSize
+	if offset < 0 {
+		offset = 0
+	}
+	tail := make([]byte, info.Size()-offset)
+	if _, err := f.ReadAt(tail, offset); err != nil && err != io.EOF {
+		return "", fmt.Errorf("unable to read audit log file: %v", err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(string(tail)), "\n")
+	last := lines[len(lines)-1]
+	if last == "" {
+		return "", nil
+	}
+	var event auditEvent
+	if err := json.Unmarshal([]byte(last), &event); err != nil || event.Hash == "" {
+		klog.ErrorS(err, "last line of audit log file is no audit event, starting a new chain", "file", path)
+		return "", nil
+	}
+	return event.Hash, nil
+}
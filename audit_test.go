@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+// readAuditEvents decodes the events written as lines of JSON and checks their chain
+func readAuditEvents(t *testing.T, data []byte, previousHash string) []auditEvent {
+	var events []auditEvent
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	for scanner.Scan() {
+		var event auditEvent
+		require.NoError(t, json.Unmarshal(scanner.Bytes(), &event))
+		hash, err := event.computeHash()
+		require.NoError(t, err)
+		assert.Equal(t, hash, event.Hash, "hash of event %d", len(events))
+		assert.Equal(t, previousHash, event.PreviousHash, "link of event %d", len(events))
+		previousHash = event.Hash
+		events = append(events, event)
+	}
+	return events
+}
+
+func TestAuditLog_Chain(t *testing.T) {
+	var buf bytes.Buffer
+	audit := newAuditLog("", auditSink{name: "buffer", Writer: &buf})
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+
+	audit.record(newAuditEvent(auditCreate, ch, "example.com", "_acme-challenge"), nil)
+	audit.record(newAuditEvent(auditDelete, ch, "example.com", "_acme-challenge"), errors.New("no such record"))
+
+	events := readAuditEvents(t, buf.Bytes(), "")
+	require.Len(t, events, 2)
+	assert.Equal(t, outcomeSuccess, events[0].Outcome)
+	assert.Empty(t, events[0].Error)
+	assert.Equal(t, outcomeError, events[1].Outcome)
+	assert.Equal(t, "no such record", events[1].Error)
+
+	// an altered event no longer matches its hash
+	events[0].Entry = "_acme-challenge.other"
+	hash, err := events[0].computeHash()
+	require.NoError(t, err)
+	assert.NotEqual(t, events[0].Hash, hash)
+
+	// without sinks, nothing is recorded
+	var none *auditLog
+	none.record(newAuditEvent(auditCreate, ch, "example.com", "_acme-challenge"), nil)
+}
+
+func TestAuditLog_Challenges(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	var buf bytes.Buffer
+	solver.audit = newAuditLog("", auditSink{name: "buffer", Writer: &buf})
+
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	ch.UID = "challenge-uid"
+	require.NoError(t, solver.Present(ch))
+	// the record exists already, so presenting again changes nothing
+	require.NoError(t, solver.Present(ch))
+	require.NoError(t, solver.CleanUp(ch))
+
+	events := readAuditEvents(t, buf.Bytes(), "")
+	require.Len(t, events, 2)
+	value := sha256.Sum256([]byte("challenge-key"))
+	for i, operation := range []string{auditCreate, auditDelete} {
+		event := events[i]
+		assert.Equal(t, operation, event.Operation)
+		assert.Equal(t, "challenge-uid", event.ChallengeUID)
+		assert.Equal(t, "default", event.Namespace)
+		assert.Equal(t, "example.com", event.Domain)
+		assert.Equal(t, "_acme-challenge", event.Entry)
+		assert.Equal(t, hex.EncodeToString(value[:]), event.ValueSha256)
+		assert.Contains(t, event.RecordUrl, fakeApi.URL()+"/dns-records/")
+		assert.NotEmpty(t, event.JobId)
+		assert.Equal(t, outcomeSuccess, event.Outcome)
+		assert.False(t, event.Time.IsZero())
+	}
+	assert.Equal(t, events[0].RecordUrl, events[1].RecordUrl)
+	assert.NotContains(t, buf.String(), "challenge-key")
+}
+
+func TestAuditLogFromEnv(t *testing.T) {
+	var mu sync.Mutex
+	var posted []byte
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "application/json", r.Header.Get("Content-Type"))
+		body, _ := ioutil.ReadAll(r.Body)
+		mu.Lock()
+		posted = append(posted, body...)
+		mu.Unlock()
+	}))
+	defer endpoint.Close()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	path := filepath.Join(t.TempDir(), "audit.log")
+	t.Setenv(envAuditSinks, "stdout, file:"+path+", "+endpoint.URL)
+	audit, err := auditLogFromEnv(stopCh)
+	require.NoError(t, err)
+	require.Len(t, audit.sinks, 3)
+
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	audit.record(newAuditEvent(auditCreate, ch, "example.com", "_acme-challenge"), nil)
+
+	// a new chain is marked as such
+	data, err := ioutil.ReadFile(path)
+	require.NoError(t, err)
+	events := readAuditEvents(t, data, "")
+	require.Len(t, events, 2)
+	assert.Equal(t, auditStart, events[0].Operation)
+	assert.Equal(t, auditCreate, events[1].Operation)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return bytes.Equal(data, posted)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// after a restart, the chain continues where the file ends
+	t.Setenv(envAuditSinks, "file:"+path)
+	audit, err = auditLogFromEnv(stopCh)
+	require.NoError(t, err)
+	audit.record(newAuditEvent(auditDelete, ch, "example.com", "_acme-challenge"), nil)
+	data, err = ioutil.ReadFile(path)
+	require.NoError(t, err)
+	events = readAuditEvents(t, data, "")
+	require.Len(t, events, 3)
+	assert.Equal(t, auditDelete, events[2].Operation)
+
+	t.Setenv(envAuditSinks, "")
+	audit, err = auditLogFromEnv(stopCh)
+	require.NoError(t, err)
+	assert.Nil(t, audit)
+
+	for _, value := range []string{"stderr", "file:", "ftp://audit.example.com"} {
+		t.Setenv(envAuditSinks, value)
+		_, err = auditLogFromEnv(stopCh)
+		assert.Error(t, err, value)
+	}
+	t.Setenv(envAuditSinks, "stdout")
+	t.Setenv(envAuditFileMaxSize, "0")
+	_, err = auditLogFromEnv(stopCh)
+	assert.Error(t, err)
+}
+
+func TestHttpAuditSink_Retry(t *testing.T) {
+	var mu sync.Mutex
+	var attempts int
+	var posted []string
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		attempts++
+		if attempts <= 2 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		body, _ := ioutil.ReadAll(r.Body)
+		posted = append(posted, string(body))
+	}))
+	defer endpoint.Close()
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	sink := newHttpAuditSink(endpoint.URL, endpoint.Client(), stopCh)
+	sink.retryDelay = time.Millisecond
+	for _, line := range []string{"{\"first\":1}\n", "{\"second\":2}\n"} {
+		_, err := sink.Write([]byte(line))
+		require.NoError(t, err)
+	}
+
+	// events are delivered in order, once the endpoint accepts them
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return assert.ObjectsAreEqual([]string{"{\"first\":1}\n", "{\"second\":2}\n"}, posted)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestHttpAuditSink_Rejected(t *testing.T) {
+	endpoint := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusForbidden)
+	}))
+	defer endpoint.Close()
+
+	sink := &httpAuditSink{url: endpoint.URL, client: http.DefaultClient}
+	err := sink.post([]byte("{}\n"))
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "403")
+
+	// a full queue drops events
+	sink.queue = make(chan []byte, 1)
+	_, err = sink.Write([]byte("{}\n"))
+	require.NoError(t, err)
+	_, err = sink.Write([]byte("{}\n"))
+	assert.Error(t, err)
+}
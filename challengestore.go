@@ -0,0 +1,96 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// cache of the Challenge resources, shared by the event recorder and the record sweeper
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"fmt"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/dynamic"
+	"k8s.io/client-go/dynamic/dynamicinformer"
+	"k8s.io/client-go/tools/cache"
+)
+
+// name of the index of the Challenges by UID
+const challengeUIDIndex = "uid"
+
+// challengeStore keeps the Challenge resources of all namespaces up to date via a watch,
+// so neither events nor sweeps have to list them
+type challengeStore struct {
+	informer cache.SharedIndexInformer
+}
+
+// newChallengeStore creates a store watching the Challenges with the client until
+// stopCh is closed
+func newChallengeStore(client dynamic.Interface, stopCh <-chan struct{}) (*challengeStore, error) {
+	factory := dynamicinformer.NewDynamicSharedInformerFactory(client, 0)
+	informer := factory.ForResource(challengeResource).Informer()
+	err := informer.AddIndexers(cache.Indexers{challengeUIDIndex: func(obj interface{}) ([]string, error) {
+		challenge, ok := obj.(metav1.Object)
+		if !ok {
+			return nil, fmt.Errorf("unexpected object type %T", obj)
+		}
+		return []string{string(challenge.GetUID())}, nil
+	}})
+	if err != nil {
+		return nil, fmt.Errorf("unable to index challenges: %v", err)
+	}
+	factory.Start(stopCh)
+	return &challengeStore{informer: informer}, nil
+}
+
+// synced reports whether the initial listing of the Challenges completed
+func (s *challengeStore) synced() bool {
+	return s.informer.HasSynced()
+}
+
+// waitForSync waits for the initial listing of the Challenges, false if stopCh was
+// closed before
+func (s *challengeStore) waitForSync(stopCh <-chan struct{}) bool {
+	return cache.WaitForCacheSync(stopCh, s.informer.HasSynced)
+}
+
+// reference returns a reference to the Challenge with the UID, nil if there is none
+func (s *challengeStore) reference(uid types.UID) (*corev1.ObjectReference, error) {
+	items, err := s.informer.GetIndexer().ByIndex(challengeUIDIndex, string(uid))
+	if err != nil {
+		return nil, fmt.Errorf("unable to look up challenge: %v", err)
+	}
+	for _, item := range items {
+		if challenge, ok := item.(metav1.Object); ok {
+			return &corev1.ObjectReference{
+				APIVersion: challengeResource.GroupVersion().String(),
+				Kind:       challengeKind,
+				Namespace:  challenge.GetNamespace(),
+				Name:       challenge.GetName(),
+				UID:        challenge.GetUID(),
+			}, nil
+		}
+	}
+	return nil, nil
+}
+
+// keys returns the keys of all Challenges, an error if they were not listed yet
+func (s *challengeStore) keys() (map[string]bool, error) {
+	if !s.synced() {
+		return nil, fmt.Errorf("challenges not listed yet")
+	}
+	keys := make(map[string]bool)
+	for _, item := range s.informer.GetStore().List() {
+		challenge, ok := item.(*unstructured.Unstructured)
+		if !ok {
+			continue
+		}
+		if key, _, _ := unstructured.NestedString(challenge.Object, "spec", "key"); key != "" {
+			keys[key] = true
+		}
+	}
+	return keys, nil
+}
@@ -0,0 +1,88 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/apis/meta/v1/unstructured"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	dynamicfake "k8s.io/client-go/dynamic/fake"
+)
+
+// newChallengeObject returns a Challenge resource with the UID and key
+func newChallengeObject(namespace, name, uid, key string) *unstructured.Unstructured {
+	challenge := &unstructured.Unstructured{Object: map[string]interface{}{
+		"spec": map[string]interface{}{"key": key},
+	}}
+	challenge.SetAPIVersion(challengeResource.GroupVersion().String())
+	challenge.SetKind(challengeKind)
+	challenge.SetNamespace(namespace)
+	challenge.SetName(name)
+	challenge.SetUID(types.UID(uid))
+	return challenge
+}
+
+// newTestChallengeStore creates a store watching the Challenges of a fake client, once
+// they were listed
+func newTestChallengeStore(t *testing.T, challenges ...runtime.Object) (*challengeStore, *dynamicfake.FakeDynamicClient) {
+	client := dynamicfake.NewSimpleDynamicClientWithCustomListKinds(runtime.NewScheme(),
+		map[schema.GroupVersionResource]string{challengeResource: challengeKind + "List"}, challenges...)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	store, err := newChallengeStore(client, stopCh)
+	require.NoError(t, err)
+	require.True(t, store.waitForSync(stopCh))
+	return store, client
+}
+
+func TestChallengeStore(t *testing.T) {
+	store, client := newTestChallengeStore(t,
+		newChallengeObject("app", "example-challenge", "challenge-uid", "challenge-key"),
+		newChallengeObject("cert-manager", "other-challenge", "other-uid", ""))
+
+	ref, err := store.reference("challenge-uid")
+	require.NoError(t, err)
+	require.NotNil(t, ref)
+	assert.Equal(t, corev1.ObjectReference{
+		APIVersion: "acme.cert-manager.io/v1",
+		Kind:       "Challenge",
+		Namespace:  "app",
+		Name:       "example-challenge",
+		UID:        "challenge-uid",
+	}, *ref)
+	ref, err = store.reference("unknown-uid")
+	require.NoError(t, err)
+	assert.Nil(t, ref)
+
+	keys, err := store.keys()
+	require.NoError(t, err)
+	assert.Equal(t, map[string]bool{"challenge-key": true}, keys)
+
+	// changes are picked up via the watch, without listing again
+	client.ClearActions()
+	_, err = client.Resource(challengeResource).Namespace("app").Create(context.Background(),
+		newChallengeObject("app", "new-challenge", "new-uid", "new-key"), metav1.CreateOptions{})
+	require.NoError(t, err)
+	require.NoError(t, client.Resource(challengeResource).Namespace("app").Delete(context.Background(), "example-challenge", metav1.DeleteOptions{}))
+	assert.Eventually(t, func() bool {
+		keys, err := store.keys()
+		return err == nil && len(keys) == 1 && keys["new-key"]
+	}, 5*time.Second, 10*time.Millisecond)
+	ref, err = store.reference("challenge-uid")
+	require.NoError(t, err)
+	assert.Nil(t, ref)
+	ref, err = store.reference("new-uid")
+	require.NoError(t, err)
+	require.NotNil(t, ref)
+	assert.Equal(t, "new-challenge", ref.Name)
+	for _, action := range client.Actions() {
+		assert.NotEqual(t, "list", action.GetVerb())
+	}
+}
@@ -0,0 +1,497 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// solver configuration, as provided per Issuer
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	// the only version of the structured configuration so far
+	configVersion = 1
+	// key within the secret holding the API key, unless configured otherwise
+	defaultSecretKey = "api-token"
+	// how long to wait for authoritative name servers to serve a new record, and how
+	// often to ask them - the wait is cut short to end before the challenge times out
+	defaultPropagationTimeout      = 20 * time.Second
+	defaultPropagationPollInterval = 2 * time.Second
+	// time left to Present() for reporting a propagation timeout before the challenge's deadline
+	propagationDeadlineMargin = 2 * time.Second
+)
+
+// variomediaSecretRef references the Kubernetes secret holding a domain's API key
+type variomediaSecretRef struct {
+	Name string `json:"name"`
+	Key  string `json:"key,omitempty"`
+	// empty for the namespace of the challenge, i.e. the Issuer's namespace; others have
+	// to be permitted via VARIOMEDIA_SECRET_NAMESPACES
+	Namespace string `json:"namespace,omitempty"`
+}
+
+// variomediaOptions are optional features that can be switched per domain
+type variomediaOptions struct {
+	// search Variomedia for the record on CleanUp() if the webhook does not know its
+	// URL, i.e. after a restart (default: true)
+	LookupOnCleanUp *bool `json:"lookupOnCleanUp,omitempty"`
+	// let Present() wait until all authoritative name servers serve the new record
+	// (default: false)
+	WaitForPropagation *bool `json:"waitForPropagation,omitempty"`
+}
+
+// variomediaSettings are the settings that can be given both in the defaults block and
+// per domain. Unset values are nil.
+type variomediaSettings struct {
+	Ttl             *int            `json:"ttl,omitempty"`
+	PollInterval    *configDuration `json:"pollInterval,omitempty"`
+	PollMaxInterval *configDuration `json:"pollMaxInterval,omitempty"`
+	JobTimeout      *configDuration `json:"jobTimeout,omitempty"`
+	// only used with option waitForPropagation
+	PropagationTimeout      *configDuration   `json:"propagationTimeout,omitempty"`
+	PropagationPollInterval *configDuration   `json:"propagationPollInterval,omitempty"`
+	Options                 variomediaOptions `json:"options,omitempty"`
+}
+
+// variomediaDomainConfig is the configuration of a single domain
+type variomediaDomainConfig struct {
+	SecretRef variomediaSecretRef `json:"secretRef"`
+	variomediaSettings
+}
+
+// configDuration is a duration given as Go duration string (i.e. "5s")
+type configDuration struct {
+	time.Duration
+}
+
+func (d *configDuration) UnmarshalJSON(data []byte) error {
+	var value string
+	if err := json.Unmarshal(data, &value); err != nil {
+		return fmt.Errorf("expected duration string (i.e. \"5s\"), got %s", data)
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return fmt.Errorf("invalid duration `%s`: must be a positive duration", value)
+	}
+	d.Duration = duration
+	return nil
+}
+
+func (d configDuration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(d.String())
+}
+
+// decodeConfig decodes the solver configuration, accepting both the structured form
+//
+//	{"version": 1, "defaults": {...}, "domains": {"example.com": {"secretRef": {"name": "..."}, ...}}}
+//
+// and the original flat form mapping each domain to the name of its secret
+//
+//	{"example.com": "variomedia-credentials"}
+func decodeConfig(data []byte) (customDNSProviderConfig, error) {
+	cfg := customDNSProviderConfig{}
+
+	var fields map[string]json.RawMessage
+	if err := json.Unmarshal(data, &fields); err != nil {
+		return cfg, fmt.Errorf("expected JSON object: %v", err)
+	}
+
+	if _, versioned := fields["version"]; !versioned {
+		_, hasDefaults := fields["defaults"]
+		_, hasDomains := fields["domains"]
+		if hasDefaults || hasDomains {
+			return cfg, fmt.Errorf("version: required, expected %d", configVersion)
+		}
+
+		// flat form
+		var secretNames map[string]string
+		if err := decodeStrict("", data, reflect.ValueOf(&secretNames).Elem()); err != nil {
+			return cfg, err
+		}
+		cfg.Version = configVersion
+		cfg.Domains = make(map[string]variomediaDomainConfig, len(secretNames))
+		for domain, secretName := range secretNames {
+			cfg.Domains[domain] = variomediaDomainConfig{SecretRef: variomediaSecretRef{Name: secretName}}
+		}
+	} else {
+		if err := decodeStrict("", data, reflect.ValueOf(&cfg).Elem()); err != nil {
+			return cfg, err
+		}
+		if cfg.Version != configVersion {
+			return cfg, fmt.Errorf("version: unsupported version %d, expected %d", cfg.Version, configVersion)
+		}
+	}
+
+	return cfg, cfg.normalize()
+}
+
+// normalize fills in default values and checks what cannot be checked while decoding
+func (cfg *customDNSProviderConfig) normalize() error {
+	if err := cfg.Defaults.validate("defaults"); err != nil {
+		return err
+	}
+
+	domains := make(map[string]variomediaDomainConfig, len(cfg.Domains))
+	for _, name := range sortedKeys(cfg.Domains) {
+		domain := cfg.Domains[name]
+		path := fmt.Sprintf("domains[%q]", name)
+
+		key := normalizeDomainName(name)
+		if err := validateDnsName(key); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if _, duplicate := domains[key]; duplicate {
+			return fmt.Errorf("%s: domain '%s' is configured more than once", path, key)
+		}
+
+		if domain.SecretRef.Name == "" {
+			return fmt.Errorf("%s.secretRef.name: required", path)
+		}
+		if domain.SecretRef.Key == "" {
+			domain.SecretRef.Key = defaultSecretKey
+		}
+		// the domain's settings are checked together with the defaults they are combined with
+		if err := domain.variomediaSettings.withDefaults(cfg.Defaults).validate(path); err != nil {
+			return err
+		}
+		domains[key] = domain
+	}
+	cfg.Domains = domains
+
+	// delegated challenges have to end up in one of the configured domains
+	aliases := make(map[string]string, len(cfg.Aliases))
+	for _, name := range sortedKeys(cfg.Aliases) {
+		path := fmt.Sprintf("aliases[%q]", name)
+		key := normalizeDomainName(name)
+		if err := validateDnsName(key); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if _, duplicate := aliases[key]; duplicate {
+			return fmt.Errorf("%s: alias for domain '%s' is configured more than once", path, key)
+		}
+		target := normalizeDomainName(cfg.Aliases[name])
+		if err := validateDnsName(target); err != nil {
+			return fmt.Errorf("%s: %v", path, err)
+		}
+		if _, _, ok := cfg.match(target); !ok {
+			return fmt.Errorf("%s: target '%s' is not within any of the configured domains", path, target)
+		}
+		aliases[key] = target
+	}
+	cfg.Aliases = aliases
+	return nil
+}
+
+// match returns the most specific configured domain the name belongs to, if any
+func (cfg *customDNSProviderConfig) match(fqdn string) (string, variomediaDomainConfig, bool) {
+	domain, ok := longestSuffixMatch(fqdn, func(domain string) bool {
+		_, ok := cfg.Domains[domain]
+		return ok
+	})
+	if !ok {
+		return "", variomediaDomainConfig{}, false
+	}
+	settings, _ := cfg.domain(domain)
+	return domain, settings, true
+}
+
+// aliasTarget returns the name a challenge is delegated to via the configured aliases:
+// the challenged domain is replaced by the alias target (i.e. with alias "example.net"
+// -> "example-net.validation.example.com", "_acme-challenge.www.example.net" becomes
+// "_acme-challenge.www.example-net.validation.example.com")
+func (cfg *customDNSProviderConfig) aliasTarget(fqdn string) (string, bool) {
+	alias, ok := longestSuffixMatch(fqdn, func(domain string) bool {
+		_, ok := cfg.Aliases[domain]
+		return ok
+	})
+	if !ok {
+		return "", false
+	}
+	return strings.TrimSuffix(fqdn, alias) + cfg.Aliases[alias], true
+}
+
+// longestSuffixMatch returns the longest domain the name belongs to (the name itself or
+// any of its parent domains) that is known
+func longestSuffixMatch(fqdn string, known func(string) bool) (string, bool) {
+	for domain := fqdn; domain != ""; {
+		if known(domain) {
+			return domain, true
+		}
+		i := strings.Index(domain, ".")
+		if i < 0 {
+			break
+		}
+		domain = domain[i+1:]
+	}
+	return "", false
+}
+
+// normalizeDomainName makes names comparable with those reported by cert-manager, so
+// "Example.COM." and "example.com" are the same
+func normalizeDomainName(name string) string {
+	return strings.TrimSuffix(strings.ToLower(strings.TrimSpace(name)), ".")
+}
+
+// validateDnsName checks that the (normalized) name is a syntactically valid DNS name
+func validateDnsName(name string) error {
+	if name == "" {
+		return fmt.Errorf("domain name must not be empty")
+	}
+	if len(name) > 253 {
+		return fmt.Errorf("domain name '%s' is too long", name)
+	}
+	for _, label := range strings.Split(name, ".") {
+		if label == "" || len(label) > 63 {
+			return fmt.Errorf("domain name '%s' has an empty or too long label", name)
+		}
+	}
+	return nil
+}
+
+// validate checks the settings against what Variomedia accepts
+func (s variomediaSettings) validate(path string) error {
+	if s.Ttl != nil && *s.Ttl < variomediaMinTtl {
+		return fmt.Errorf("%s.ttl: %d is below Variomedia's minimum TTL of %d seconds", path, *s.Ttl, variomediaMinTtl)
+	}
+	if s.PollInterval != nil && s.PollMaxInterval != nil && s.PollMaxInterval.Duration < s.PollInterval.Duration {
+		return fmt.Errorf("%s.pollMaxInterval: %s is below pollInterval %s", path, s.PollMaxInterval.Duration, s.PollInterval.Duration)
+	}
+	return nil
+}
+
+// domain returns the configuration of the given domain, with unset values taken from
+// the defaults block
+func (cfg *customDNSProviderConfig) domain(name string) (variomediaDomainConfig, bool) {
+	domain, ok := cfg.Domains[name]
+	if !ok {
+		return domain, false
+	}
+	domain.variomediaSettings = domain.variomediaSettings.withDefaults(cfg.Defaults)
+	return domain, true
+}
+
+// withDefaults returns the settings with all unset values taken from the defaults
+func (s variomediaSettings) withDefaults(defaults variomediaSettings) variomediaSettings {
+	if s.Ttl == nil {
+		s.Ttl = defaults.Ttl
+	}
+	if s.PollInterval == nil {
+		s.PollInterval = defaults.PollInterval
+	}
+	if s.PollMaxInterval == nil {
+		s.PollMaxInterval = defaults.PollMaxInterval
+	}
+	if s.JobTimeout == nil {
+		s.JobTimeout = defaults.JobTimeout
+	}
+	if s.PropagationTimeout == nil {
+		s.PropagationTimeout = defaults.PropagationTimeout
+	}
+	if s.PropagationPollInterval == nil {
+		s.PropagationPollInterval = defaults.PropagationPollInterval
+	}
+	if s.Options.LookupOnCleanUp == nil {
+		s.Options.LookupOnCleanUp = defaults.Options.LookupOnCleanUp
+	}
+	if s.Options.WaitForPropagation == nil {
+		s.Options.WaitForPropagation = defaults.Options.WaitForPropagation
+	}
+	return s
+}
+
+// ttl returns the TTL to use for TXT records
+func (s variomediaSettings) ttl() int {
+	if s.Ttl == nil {
+		return variomediaMinTtl
+	}
+	return *s.Ttl
+}
+
+// lookupOnCleanUp reports whether CleanUp() may search Variomedia for the record
+func (s variomediaSettings) lookupOnCleanUp() bool {
+	return s.Options.LookupOnCleanUp == nil || *s.Options.LookupOnCleanUp
+}
+
+// waitForPropagation reports whether Present() waits for the authoritative name servers
+func (s variomediaSettings) waitForPropagation() bool {
+	return s.Options.WaitForPropagation != nil && *s.Options.WaitForPropagation
+}
+
+// propagationTimeout returns how long to wait for the authoritative name servers
+func (s variomediaSettings) propagationTimeout() time.Duration {
+	if s.PropagationTimeout == nil {
+		return defaultPropagationTimeout
+	}
+	return s.PropagationTimeout.Duration
+}
+
+// propagationPollInterval returns how often to ask the authoritative name servers
+func (s variomediaSettings) propagationPollInterval() time.Duration {
+	if s.PropagationPollInterval == nil {
+		return defaultPropagationPollInterval
+	}
+	return s.PropagationPollInterval.Duration
+}
+
+// jobWaiter applies the configured polling settings to the given job waiter
+func (s variomediaSettings) jobWaiter(w variomediaJobWaiter) variomediaJobWaiter {
+	if s.PollInterval != nil {
+		w.InitialDelay = s.PollInterval.Duration
+	}
+	if s.PollMaxInterval != nil {
+		w.MaxDelay = s.PollMaxInterval.Duration
+	}
+	if s.JobTimeout != nil {
+		w.Deadline = s.JobTimeout.Duration
+	}
+	// configured intervals are checked by normalize(), but one of them may still come
+	// from the webhook's environment
+	if w.MaxDelay < w.InitialDelay {
+		w.MaxDelay = w.InitialDelay
+	}
+	return w
+}
+
+// decodeStrict decodes JSON into v like json.Unmarshal, but rejects unknown fields and
+// reports errors with the path of the offending field (i.e. `domains["example.com"].ttl`)
+func decodeStrict(path string, data []byte, v reflect.Value) error {
+	// types with their own decoding
+	if u, ok := v.Addr().Interface().(json.Unmarshaler); ok {
+		if err := u.UnmarshalJSON(data); err != nil {
+			return fmt.Errorf("%s: %v", displayPath(path), err)
+		}
+		return nil
+	}
+
+	switch v.Kind() {
+	case reflect.Ptr:
+		if string(bytes.TrimSpace(data)) == "null" {
+			v.Set(reflect.Zero(v.Type()))
+			return nil
+		}
+		if v.IsNil() {
+			v.Set(reflect.New(v.Type().Elem()))
+		}
+		return decodeStrict(path, data, v.Elem())
+
+	case reflect.Struct:
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(data, &values); err != nil {
+			return typeError(path, v.Type(), err)
+		}
+		fields := jsonFields(v)
+		for _, name := range sortedKeys(values) {
+			field, ok := fields[name]
+			if !ok {
+				return fmt.Errorf("%s: unknown field", joinPath(path, name))
+			}
+			if err := decodeStrict(joinPath(path, name), values[name], field); err != nil {
+				return err
+			}
+		}
+		return nil
+
+	case reflect.Map:
+		var values map[string]json.RawMessage
+		if err := json.Unmarshal(data, &values); err != nil {
+			return typeError(path, v.Type(), err)
+		}
+		m := reflect.MakeMapWithSize(v.Type(), len(values))
+		for _, key := range sortedKeys(values) {
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := decodeStrict(fmt.Sprintf("%s[%q]", path, key), values[key], elem); err != nil {
+				return err
+			}
+			m.SetMapIndex(reflect.ValueOf(key), elem)
+		}
+		v.Set(m)
+		return nil
+	}
+
+	if err := json.Unmarshal(data, v.Addr().Interface()); err != nil {
+		return typeError(path, v.Type(), err)
+	}
+	return nil
+}
+
+// jsonFields maps the JSON names of a struct's fields to the fields, including those of
+// embedded structs
+func jsonFields(v reflect.Value) map[string]reflect.Value {
+	fields := map[string]reflect.Value{}
+	for i := 0; i < v.NumField(); i++ {
+		field := v.Type().Field(i)
+		name := strings.Split(field.Tag.Get("json"), ",")[0]
+		if field.Anonymous && name == "" && field.Type.Kind() == reflect.Struct {
+			for embeddedName, embeddedField := range jsonFields(v.Field(i)) {
+				fields[embeddedName] = embeddedField
+			}
+			continue
+		}
+		if name == "" || name == "-" {
+			continue
+		}
+		fields[name] = v.Field(i)
+	}
+	return fields
+}
+
+// typeError turns a JSON decoding error into a message naming the offending field
+func typeError(path string, t reflect.Type, err error) error {
+	if typeErr, ok := err.(*json.UnmarshalTypeError); ok {
+		return fmt.Errorf("%s: expected %s, got %s", displayPath(path), jsonTypeName(t), typeErr.Value)
+	}
+	return fmt.Errorf("%s: %v", displayPath(path), err)
+}
+
+// jsonTypeName names the JSON type expected for a Go type
+func jsonTypeName(t reflect.Type) string {
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		return "object"
+	case reflect.String:
+		return "string"
+	case reflect.Bool:
+		return "boolean"
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64,
+		reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return "integer"
+	case reflect.Float32, reflect.Float64:
+		return "number"
+	case reflect.Slice, reflect.Array:
+		return "array"
+	}
+	return t.String()
+}
+
+func joinPath(path, name string) string {
+	if path == "" {
+		return name
+	}
+	return path + "." + name
+}
+
+func displayPath(path string) string {
+	if path == "" {
+		return "config"
+	}
+	return path
+}
+
+// sortedKeys returns the keys of a map with string keys in order, so errors are reported
+// deterministically
+func sortedKeys(m interface{}) []string {
+	keys := []string{}
+	for _, key := range reflect.ValueOf(m).MapKeys() {
+		keys = append(keys, key.String())
+	}
+	sort.Strings(keys)
+	return keys
+}
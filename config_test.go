@@ -0,0 +1,133 @@
+package main
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+func TestDecodeConfig_FlatForm(t *testing.T) {
+	cfg, err := decodeConfig([]byte(`{"example.com": "credentials-01", "Example.ORG.": "credentials-02"}`))
+	require.NoError(t, err)
+	assert.Equal(t, configVersion, cfg.Version)
+	assert.Equal(t, map[string]variomediaDomainConfig{
+		"example.com": {SecretRef: variomediaSecretRef{Name: "credentials-01", Key: "api-token"}},
+		"example.org": {SecretRef: variomediaSecretRef{Name: "credentials-02", Key: "api-token"}},
+	}, cfg.Domains)
+
+	domain, ok := cfg.domain("example.com")
+	require.True(t, ok)
+	assert.Equal(t, variomediaMinTtl, domain.ttl())
+	assert.True(t, domain.lookupOnCleanUp())
+	assert.Equal(t, defaultJobWaiter(), domain.jobWaiter(defaultJobWaiter()))
+}
+
+func TestDecodeConfig_StructuredForm(t *testing.T) {
+	cfg, err := decodeConfig([]byte(`{
+		"version": 1,
+		"defaults": {"ttl": 600, "pollInterval": "1s", "options": {"lookupOnCleanUp": false}},
+		"domains": {
+			"example.com": {"secretRef": {"name": "credentials-01"}},
+			"example.org": {"secretRef": {"name": "credentials-02", "key": "token"}, "ttl": 900, "jobTimeout": "2m", "options": {"lookupOnCleanUp": true}}
+		}
+	}`))
+	require.NoError(t, err)
+
+	domain, ok := cfg.domain("example.com")
+	require.True(t, ok)
+	assert.Equal(t, variomediaSecretRef{Name: "credentials-01", Key: "api-token"}, domain.SecretRef)
+	assert.Equal(t, 600, domain.ttl())
+	assert.False(t, domain.lookupOnCleanUp())
+	w := domain.jobWaiter(defaultJobWaiter())
+	assert.Equal(t, time.Second, w.InitialDelay)
+	assert.Equal(t, defaultJobWaiter().Deadline, w.Deadline)
+
+	domain, ok = cfg.domain("example.org")
+	require.True(t, ok)
+	assert.Equal(t, variomediaSecretRef{Name: "credentials-02", Key: "token"}, domain.SecretRef)
+	assert.Equal(t, 900, domain.ttl())
+	assert.True(t, domain.lookupOnCleanUp())
+	w = domain.jobWaiter(defaultJobWaiter())
+	assert.Equal(t, time.Second, w.InitialDelay)
+	assert.Equal(t, 2*time.Minute, w.Deadline)
+
+	_, ok = cfg.domain("example.net")
+	assert.False(t, ok)
+}
+
+func TestDecodeConfig_Errors(t *testing.T) {
+	tests := []struct {
+		name   string
+		config string
+		want   string
+	}{
+		{name: "not an object", config: `"example.com"`, want: "expected JSON object"},
+		{name: "flat form with non-string", config: `{"example.com": {"secretRef": {"name": "x"}}}`, want: `["example.com"]: expected string, got object`},
+		{name: "missing version", config: `{"domains": {}}`, want: "version: required"},
+		{name: "unsupported version", config: `{"version": 2}`, want: "version: unsupported version 2"},
+		{name: "unknown top-level field", config: `{"version": 1, "domain": {}}`, want: "domain: unknown field"},
+		{name: "unknown domain field", config: `{"version": 1, "domains": {"example.com": {"secretRef": {"name": "x"}, "ttll": 300}}}`, want: `domains["example.com"].ttll: unknown field`},
+		{name: "unknown option", config: `{"version": 1, "defaults": {"options": {"lookup": true}}}`, want: "defaults.options.lookup: unknown field"},
+		{name: "wrong type", config: `{"version": 1, "domains": {"example.com": {"secretRef": {"name": "x"}, "ttl": "300"}}}`, want: `domains["example.com"].ttl: expected integer, got string`},
+		{name: "invalid duration", config: `{"version": 1, "defaults": {"pollInterval": "soon"}}`, want: "defaults.pollInterval: invalid duration `soon`"},
+		{name: "missing secret name", config: `{"version": 1, "domains": {"example.com": {"secretRef": {"key": "token"}}}}`, want: `domains["example.com"].secretRef.name: required`},
+		{name: "default TTL below minimum", config: `{"version": 1, "defaults": {"ttl": 60}}`, want: "defaults.ttl: 60 is below Variomedia's minimum TTL of 300 seconds"},
+		{name: "domain TTL below minimum", config: `{"version": 1, "domains": {"example.com": {"secretRef": {"name": "x"}, "ttl": 299}}}`, want: `domains["example.com"].ttl: 299 is below Variomedia's minimum TTL of 300 seconds`},
+		{name: "default poll intervals", config: `{"version": 1, "defaults": {"pollInterval": "10s", "pollMaxInterval": "5s"}}`, want: "defaults.pollMaxInterval: 5s is below pollInterval 10s"},
+		{name: "domain poll interval above default maximum", config: `{"version": 1, "defaults": {"pollMaxInterval": "5s"}, "domains": {"example.com": {"secretRef": {"name": "x"}, "pollInterval": "10s"}}}`, want: `domains["example.com"].pollMaxInterval: 5s is below pollInterval 10s`},
+		{name: "duplicate domain", config: `{"example.com": "x", "example.com.": "y"}`, want: "configured more than once"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, err := decodeConfig([]byte(tt.config))
+			require.Error(t, err)
+			assert.Contains(t, err.Error(), tt.want)
+		})
+	}
+}
+
+func TestPresent_StructuredConfig(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "fake-api-token")
+
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "key")
+	ch.Config = &extapi.JSON{Raw: []byte(`{"version": 1, "defaults": {"ttl": 900}, "domains": {"example.com": {"secretRef": {"name": "variomedia-credentials"}}}}`)}
+	require.NoError(t, solver.Present(ch))
+	records := fakeApi.Records()
+	require.Len(t, records, 1)
+	assert.Equal(t, 900, records[0].Ttl)
+
+	require.NoError(t, solver.CleanUp(ch))
+	assert.Empty(t, fakeApi.Records())
+}
+
+func TestDecodeConfig_Aliases(t *testing.T) {
+	cfg, err := decodeConfig([]byte(`{
+		"version": 1,
+		"domains": {"validation.example.com": {"secretRef": {"name": "credentials"}}},
+		"aliases": {"Example.NET.": "example-net.validation.example.com."}
+	}`))
+	require.NoError(t, err)
+	assert.Equal(t, map[string]string{"example.net": "example-net.validation.example.com"}, cfg.Aliases)
+
+	target, ok := cfg.aliasTarget("_acme-challenge.www.example.net")
+	assert.True(t, ok)
+	assert.Equal(t, "_acme-challenge.www.example-net.validation.example.com", target)
+	_, ok = cfg.aliasTarget("_acme-challenge.example.org")
+	assert.False(t, ok)
+
+	for config, want := range map[string]string{
+		`{"version": 1, "domains": {"validation.example.com": {"secretRef": {"name": "x"}}}, "aliases": {"example.net": "example.org"}}`:               `aliases["example.net"]: target 'example.org' is not within any of the configured domains`,
+		`{"version": 1, "domains": {"validation.example.com": {"secretRef": {"name": "x"}}}, "aliases": {"example.net": "a..validation.example.com"}}`: `aliases["example.net"]: domain name 'a..validation.example.com' has an empty or too long label`,
+		`{"version": 1, "aliases": {"example.net": 1}}`: `aliases["example.net"]: expected string, got number`,
+	} {
+		_, err := decodeConfig([]byte(config))
+		require.Error(t, err)
+		assert.Contains(t, err.Error(), want)
+	}
+}
@@ -0,0 +1,71 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// cache of the DNS entries created by the webhook
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"sync"
+)
+
+// dnsEntryCache keeps the URLs of the DNS entries created by Present(), so that CleanUp()
+// usually doesn't have to look them up at Variomedia. It is safe for concurrent use, as
+// cert-manager calls the webhook concurrently i.e. for multi-SAN certificates.
+// The zero value is an empty cache ready to use.
+type dnsEntryCache struct {
+	sync.Mutex
+	// DNS entry URLs: by client domain, by entry name, by key value
+	urls map[string]map[string]map[string]string
+}
+
+// get returns the cached URL of the DNS entry, or an empty string if unknown
+func (c *dnsEntryCache) get(domain, entry, key string) string {
+	c.Lock()
+	defer c.Unlock()
+	return c.urls[domain][entry][key]
+}
+
+// set stores the URL of the DNS entry, making sure each level of map exists
+func (c *dnsEntryCache) set(domain, entry, key, url string) {
+	c.Lock()
+	defer c.Unlock()
+	if c.urls == nil {
+		c.urls = make(map[string]map[string]map[string]string)
+	}
+	if _, ok := c.urls[domain]; !ok {
+		c.urls[domain] = make(map[string]map[string]string)
+	}
+	if _, ok := c.urls[domain][entry]; !ok {
+		c.urls[domain][entry] = make(map[string]string)
+	}
+	c.urls[domain][entry][key] = url
+}
+
+// delete removes the DNS entry from the cache, pruning maps that became empty so
+// that the cache doesn't grow over time
+func (c *dnsEntryCache) delete(domain, entry, key string) {
+	c.Lock()
+	defer c.Unlock()
+	delete(c.urls[domain][entry], key)
+	if len(c.urls[domain][entry]) == 0 {
+		delete(c.urls[domain], entry)
+	}
+	if len(c.urls[domain]) == 0 {
+		delete(c.urls, domain)
+	}
+}
+
+// len returns the number of DNS entries currently cached
+func (c *dnsEntryCache) len() int {
+	c.Lock()
+	defer c.Unlock()
+	count := 0
+	for _, entries := range c.urls {
+		for _, keys := range entries {
+			count += len(keys)
+		}
+	}
+	return count
+}
@@ -0,0 +1,32 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDnsEntryCache(t *testing.T) {
+	var cache dnsEntryCache
+	assert.Empty(t, cache.get("example.com", "_acme-challenge", "key1"))
+
+	cache.set("example.com", "_acme-challenge", "key1", "url1")
+	cache.set("example.com", "_acme-challenge", "key2", "url2")
+	cache.set("example.org", "_acme-challenge.www", "key1", "url3")
+	assert.Equal(t, 3, cache.len())
+	assert.Equal(t, "url1", cache.get("example.com", "_acme-challenge", "key1"))
+	assert.Equal(t, "url3", cache.get("example.org", "_acme-challenge.www", "key1"))
+
+	cache.delete("example.com", "_acme-challenge", "key1")
+	assert.Empty(t, cache.get("example.com", "_acme-challenge", "key1"))
+	assert.Equal(t, "url2", cache.get("example.com", "_acme-challenge", "key2"))
+
+	// deleting unknown entries is fine
+	cache.delete("example.net", "_acme-challenge", "key1")
+
+	// empty maps are pruned
+	cache.delete("example.com", "_acme-challenge", "key2")
+	cache.delete("example.org", "_acme-challenge.www", "key1")
+	assert.Equal(t, 0, cache.len())
+	assert.Empty(t, cache.urls)
+}
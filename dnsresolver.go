@@ -0,0 +1,237 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// DNS lookups, i.e. to follow CNAMEs of delegated challenges
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/miekg/dns"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// how many CNAMEs are followed before giving up, i.e. on loops
+	maxCNAMEHops = 8
+	// where to find the system's name servers
+	resolvConfPath = "/etc/resolv.conf"
+	// port authoritative name servers are queried on
+	dnsPort = "53"
+)
+
+// dnsResolver sends DNS queries to a fixed list of name servers
+type dnsResolver struct {
+	// name servers as "host:port"
+	servers []string
+	client  *dns.Client
+	// port to query authoritative name servers on - only changed by tests
+	authoritativePort string
+}
+
+// newDnsResolver creates a resolver querying the given name servers in order. Servers
+// without a port are queried on port 53.
+func newDnsResolver(servers []string) *dnsResolver {
+	r := &dnsResolver{client: new(dns.Client), authoritativePort: dnsPort}
+	for _, server := range servers {
+		if _, _, err := net.SplitHostPort(server); err != nil {
+			server = net.JoinHostPort(server, dnsPort)
+		}
+		r.servers = append(r.servers, server)
+	}
+	return r
+}
+
+// dnsResolverFromEnv creates a resolver using the name servers from the webhook's
+// environment or, if not set, from /etc/resolv.conf
+func dnsResolverFromEnv() (*dnsResolver, error) {
+	var servers []string
+	for _, server := range strings.Split(os.Getenv(envDnsServers), ",") {
+		if server = strings.TrimSpace(server); server != "" {
+			servers = append(servers, server)
+		}
+	}
+	if len(servers) == 0 {
+		conf, err := dns.ClientConfigFromFile(resolvConfPath)
+		if err != nil {
+			return nil, fmt.Errorf("unable to determine name servers from %s (set %s instead): %v", resolvConfPath, envDnsServers, err)
+		}
+		for _, server := range conf.Servers {
+			servers = append(servers, net.JoinHostPort(server, conf.Port))
+		}
+	}
+	return newDnsResolver(servers), nil
+}
+
+// query asks the name servers in turn until one of them answers, be it with an error code
+func (r *dnsResolver) query(ctx context.Context, name string, qtype uint16) (*dns.Msg, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(name), qtype)
+
+	var err error
+	for _, server := range r.servers {
+		var in *dns.Msg
+		in, _, err = r.client.ExchangeContext(ctx, msg, server)
+		if err == nil {
+			return in, nil
+		}
+		klog.V(4).InfoS("DNS query failed", "name", name, "type", dns.TypeToString[qtype], "server", server, "error", err)
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = fmt.Errorf("no name servers configured")
+	}
+	return nil, fmt.Errorf("unable to query %s record of '%s': %v", dns.TypeToString[qtype], name, err)
+}
+
+// followCNAME returns the name the given name is an alias for, following CNAME chains,
+// or the name itself if it is no alias. Names are returned without trailing dot.
+func (r *dnsResolver) followCNAME(ctx context.Context, name string) (string, error) {
+	name = strings.TrimSuffix(name, ".")
+	for hops := 0; hops <= maxCNAMEHops; hops++ {
+		in, err := r.query(ctx, name, dns.TypeCNAME)
+		if err != nil {
+			return "", err
+		}
+		target := ""
+		for _, rr := range in.Answer {
+			if cname, ok := rr.(*dns.CNAME); ok && strings.EqualFold(strings.TrimSuffix(cname.Hdr.Name, "."), name) {
+				target = strings.TrimSuffix(cname.Target, ".")
+			}
+		}
+		if target == "" {
+			return name, nil
+		}
+		klog.V(4).InfoS("following CNAME", "name", name, "target", target)
+		name = target
+	}
+	return "", fmt.Errorf("more than %d CNAMEs to follow for '%s'", maxCNAMEHops, name)
+}
+
+// authoritativeServers returns the addresses ("host:port") of all name servers
+// authoritative for the zone
+func (r *dnsResolver) authoritativeServers(ctx context.Context, zone string) ([]string, error) {
+	in, err := r.query(ctx, zone, dns.TypeNS)
+	if err != nil {
+		return nil, err
+	}
+	if in.Rcode != dns.RcodeSuccess {
+		return nil, fmt.Errorf("unable to query NS records of '%s': %s", zone, dns.RcodeToString[in.Rcode])
+	}
+
+	var servers []string
+	for _, rr := range in.Answer {
+		ns, ok := rr.(*dns.NS)
+		if !ok {
+			continue
+		}
+		addresses, err := r.lookupAddresses(ctx, ns.Ns)
+		if err != nil {
+			return nil, err
+		}
+		for _, address := range addresses {
+			servers = append(servers, net.JoinHostPort(address, r.authoritativePort))
+		}
+	}
+	if len(servers) == 0 {
+		return nil, fmt.Errorf("no authoritative name servers found for '%s'", zone)
+	}
+	return servers, nil
+}
+
+// lookupAddresses returns the IPv4 and IPv6 addresses of the host
+func (r *dnsResolver) lookupAddresses(ctx context.Context, host string) ([]string, error) {
+	var addresses []string
+	var err error
+	for _, qtype := range []uint16{dns.TypeA, dns.TypeAAAA} {
+		var in *dns.Msg
+		in, err = r.query(ctx, host, qtype)
+		if err != nil {
+			continue
+		}
+		for _, rr := range in.Answer {
+			switch rr := rr.(type) {
+			case *dns.A:
+				addresses = append(addresses, rr.A.String())
+			case *dns.AAAA:
+				addresses = append(addresses, rr.AAAA.String())
+			}
+		}
+	}
+	// a host with addresses of one family only is fine
+	if len(addresses) == 0 {
+		if err == nil {
+			err = fmt.Errorf("no addresses found")
+		}
+		return nil, fmt.Errorf("unable to look up name server '%s': %v", host, err)
+	}
+	return addresses, nil
+}
+
+// servesTxt reports whether the name server itself (without recursion) answers with the
+// TXT record
+func (r *dnsResolver) servesTxt(ctx context.Context, server, fqdn, value string) (bool, error) {
+	msg := new(dns.Msg)
+	msg.SetQuestion(dns.Fqdn(fqdn), dns.TypeTXT)
+	msg.RecursionDesired = false
+	in, _, err := r.client.ExchangeContext(ctx, msg, server)
+	if err != nil {
+		return false, err
+	}
+	for _, rr := range in.Answer {
+		if txt, ok := rr.(*dns.TXT); ok && strings.Join(txt.Txt, "") == value {
+			return true, nil
+		}
+	}
+	return false, nil
+}
+
+// waitForTxt waits until all name servers authoritative for the zone serve the TXT record,
+// checking the remaining ones every interval. It gives up when the context is done.
+func (r *dnsResolver) waitForTxt(ctx context.Context, zone, fqdn, value string, interval time.Duration) error {
+	klog.V(4).InfoS("waitForTxt() called")
+	klog.V(5).InfoS("parameters", "zone", zone, "fqdn", fqdn, "interval", interval)
+
+	servers, err := r.authoritativeServers(ctx, zone)
+	if err != nil {
+		klog.ErrorS(err, "waitForTxt() finished with error")
+		return err
+	}
+
+	pending := servers
+	for {
+		var stillPending []string
+		for _, server := range pending {
+			served, err := r.servesTxt(ctx, server, fqdn, value)
+			if err != nil {
+				klog.V(4).InfoS("unable to query authoritative name server", "server", server, "fqdn", fqdn, "error", err)
+			}
+			if !served {
+				stillPending = append(stillPending, server)
+			}
+		}
+		pending = stillPending
+		if len(pending) == 0 {
+			klog.V(4).InfoS("waitForTxt() finished", "servers", servers)
+			return nil
+		}
+		klog.V(4).InfoS("TXT record not yet served by all authoritative name servers", "fqdn", fqdn, "pending", pending)
+
+		select {
+		case <-ctx.Done():
+			err := fmt.Errorf("TXT record '%s' not served by authoritative name servers %v in time: %v", fqdn, pending, ctx.Err())
+			klog.ErrorS(err, "waitForTxt() finished with error")
+			return err
+		case <-time.After(interval):
+		}
+	}
+}
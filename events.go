@@ -0,0 +1,150 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// Kubernetes events on the Challenge resources, telling how solving them progresses
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"fmt"
+
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime/schema"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/kubernetes/scheme"
+	typedcorev1 "k8s.io/client-go/kubernetes/typed/core/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// source of the events
+	eventComponent = "cert-manager-webhook-variomedia"
+	// number of events waiting to be recorded, further events are dropped
+	eventQueueSize = 100
+	// kind of the Challenge resources events are recorded on
+	challengeKind = "Challenge"
+)
+
+// reasons of the recorded events
+const (
+	reasonRecordCreated        = "RecordCreated"
+	reasonJobPending           = "DNSJobPending"
+	reasonRateLimited          = "RateLimited"
+	reasonPropagationConfirmed = "PropagationConfirmed"
+	reasonCleanedUp            = "CleanedUp"
+	reasonCleanUpFailed        = "CleanUpFailed"
+)
+
+// type and reason of the events recorded for the Variomedia client's events
+var clientEventReasons = map[variomediaClientEvent]struct{ eventType, reason string }{
+	variomediaEventRateLimited: {corev1.EventTypeWarning, reasonRateLimited},
+	variomediaEventJobPending:  {corev1.EventTypeNormal, reasonJobPending},
+}
+
+// the Challenge resources created by cert-manager
+var challengeResource = schema.GroupVersionResource{Group: "acme.cert-manager.io", Version: "v1", Resource: "challenges"}
+
+// challengeEvents records events on the Challenge resources the challenge requests
+// originate from, so "kubectl describe challenge" shows what the webhook did.
+// Challenge requests carry the Challenge's UID only, so the Challenge is looked up in
+// the Challenge store. Events are recorded in the background, so they never delay the
+// challenges.
+type challengeEvents struct {
+	challenges *challengeStore
+	recorder   record.EventRecorder
+	queue      chan queuedEvent
+}
+
+// queuedEvent is an event waiting to be recorded on the Challenge with the UID
+type queuedEvent struct {
+	uid       types.UID
+	eventType string
+	reason    string
+	message   string
+}
+
+// newChallengeEvents creates an event recorder looking up Challenges in the store,
+// recording events until stopCh is closed
+func newChallengeEvents(challenges *challengeStore, recorder record.EventRecorder, stopCh <-chan struct{}) *challengeEvents {
+	e := &challengeEvents{
+		challenges: challenges,
+		recorder:   recorder,
+		queue:      make(chan queuedEvent, eventQueueSize),
+	}
+	go e.run(stopCh)
+	return e
+}
+
+// newClusterChallengeEvents creates an event recorder sending the events to the
+// Kubernetes API server until stopCh is closed
+func newClusterChallengeEvents(challenges *challengeStore, cl kubernetes.Interface, stopCh <-chan struct{}) *challengeEvents {
+	broadcaster := record.NewBroadcaster()
+	broadcaster.StartRecordingToSink(&typedcorev1.EventSinkImpl{Interface: cl.CoreV1().Events("")})
+	go func() {
+		<-stopCh
+		broadcaster.Shutdown()
+	}()
+	recorder := broadcaster.NewRecorder(scheme.Scheme, corev1.EventSource{Component: eventComponent})
+	return newChallengeEvents(challenges, recorder, stopCh)
+}
+
+// record queues an event for the challenge's Challenge resource - it is recorded if the
+// Challenge is found
+func (e *challengeEvents) record(ch *v1alpha1.ChallengeRequest, eventType, reason, messageFmt string, args ...interface{}) {
+	if e == nil || ch.UID == "" {
+		return
+	}
+	event := queuedEvent{
+		uid:       ch.UID,
+		eventType: eventType,
+		reason:    reason,
+		message:   fmt.Sprintf(messageFmt, args...),
+	}
+	select {
+	case e.queue <- event:
+	default:
+		klog.V(2).InfoS("too many events waiting to be recorded, dropping event", "uid", ch.UID, "reason", reason)
+	}
+}
+
+// handler returns an event handler for the Variomedia client, recording its events on
+// the challenge's Challenge resource
+func (e *challengeEvents) handler(ch *v1alpha1.ChallengeRequest) variomediaEventHandler {
+	if e == nil {
+		return nil
+	}
+	return func(event variomediaClientEvent, message string) {
+		if reason, ok := clientEventReasons[event]; ok {
+			e.record(ch, reason.eventType, reason.reason, "%s", message)
+		}
+	}
+}
+
+// run records the queued events in order, once the Challenges were listed, until
+// stopCh is closed
+func (e *challengeEvents) run(stopCh <-chan struct{}) {
+	if !e.challenges.waitForSync(stopCh) {
+		return
+	}
+	for {
+		select {
+		case <-stopCh:
+			return
+		case event := <-e.queue:
+			ref, err := e.challenges.reference(event.uid)
+			if err != nil {
+				klog.ErrorS(err, "unable to look up challenge to record events on", "uid", event.uid)
+				continue
+			}
+			if ref == nil {
+				klog.V(4).InfoS("no challenge to record events on", "uid", event.uid)
+				continue
+			}
+			e.recorder.Event(ref, event.eventType, event.reason, event.message)
+		}
+	}
+}
@@ -0,0 +1,100 @@
+package main
+
+import (
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+// newTestChallengeEvents creates challenge events recorded by a fake recorder, finding
+// a Challenge with the given UID in the namespace
+func newTestChallengeEvents(t *testing.T, namespace, uid string) (*challengeEvents, *record.FakeRecorder) {
+	challenges, _ := newTestChallengeStore(t, newChallengeObject(namespace, "example-challenge", uid, "challenge-key"))
+	recorder := record.NewFakeRecorder(100)
+	stopCh := make(chan struct{})
+	t.Cleanup(func() { close(stopCh) })
+	return newChallengeEvents(challenges, recorder, stopCh), recorder
+}
+
+// recordedReasons waits for the given number of events to be recorded and returns their
+// reasons, with their type
+func recordedReasons(t *testing.T, recorder *record.FakeRecorder, count int) []string {
+	var reasons []string
+	timeout := time.After(5 * time.Second)
+	for len(reasons) < count {
+		select {
+		case event := <-recorder.Events:
+			fields := strings.Fields(event)
+			reasons = append(reasons, fields[0]+" "+fields[1])
+		case <-timeout:
+			t.Errorf("%d of %d events recorded", len(reasons), count)
+			return reasons
+		}
+	}
+	// no more events than expected
+	select {
+	case event := <-recorder.Events:
+		t.Errorf("unexpected event %s", event)
+	case <-time.After(50 * time.Millisecond):
+	}
+	return reasons
+}
+
+func TestChallengeEvents_Challenge(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	fakeApi.PendingPolls = 1
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	solver.jobWaiter = variomediaJobWaiter{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	var recorder *record.FakeRecorder
+	solver.events, recorder = newTestChallengeEvents(t, "default", "challenge-uid")
+
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	ch.UID = "challenge-uid"
+	fakeApi.Throttle(1)
+	require.NoError(t, solver.Present(ch))
+	assert.Equal(t, []string{
+		corev1.EventTypeWarning + " " + reasonRateLimited,
+		corev1.EventTypeNormal + " " + reasonJobPending,
+		corev1.EventTypeNormal + " " + reasonRecordCreated,
+	}, recordedReasons(t, recorder, 3))
+
+	require.NoError(t, solver.CleanUp(ch))
+	assert.Equal(t, []string{
+		corev1.EventTypeNormal + " " + reasonJobPending,
+		corev1.EventTypeNormal + " " + reasonCleanedUp,
+	}, recordedReasons(t, recorder, 2))
+
+	// failures are recorded as warnings
+	ch.ResolvedFQDN = "_acme-challenge.example.net."
+	require.Error(t, solver.CleanUp(ch))
+	assert.Equal(t, []string{corev1.EventTypeWarning + " " + reasonCleanUpFailed}, recordedReasons(t, recorder, 1))
+
+	// challenges not found get no events
+	ch = newTestChallenge("example.com.", "_acme-challenge.example.com.", "other-key")
+	ch.UID = "unknown-uid"
+	require.NoError(t, solver.Present(ch))
+	require.NoError(t, solver.CleanUp(ch))
+	assert.Empty(t, recordedReasons(t, recorder, 0))
+}
+
+func TestChallengeEvents_ClusterIssuer(t *testing.T) {
+	// for ClusterIssuers, the Challenge is not in the resource namespace
+	events, recorder := newTestChallengeEvents(t, "app", "challenge-uid")
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	ch.ResourceNamespace = "cert-manager"
+	ch.UID = "challenge-uid"
+	events.record(ch, corev1.EventTypeNormal, reasonCleanedUp, "cleaned up")
+	assert.Equal(t, []string{corev1.EventTypeNormal + " " + reasonCleanedUp}, recordedReasons(t, recorder, 1))
+
+	// challenges without UID get no events
+	ch.UID = ""
+	events.record(ch, corev1.EventTypeNormal, reasonCleanedUp, "cleaned up")
+	assert.Empty(t, recordedReasons(t, recorder, 0))
+}
@@ -0,0 +1,124 @@
+package fakevariomedia
+
+import (
+	"fmt"
+	"net"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// NameServer is the name of the (only) name server of all domains served by StartDNS(),
+// resolving to 127.0.0.1
+const NameServer = "ns.fake-variomedia.invalid."
+
+// StartDNS serves the stored records via DNS on a local UDP port and returns the
+// server's address ("host:port")
+func (s *Server) StartDNS() (string, error) {
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	started := make(chan struct{})
+	s.dnsServer = &dns.Server{
+		PacketConn:        conn,
+		Handler:           dns.HandlerFunc(s.handleDNSRequest),
+		NotifyStartedFunc: func() { close(started) },
+	}
+	go s.dnsServer.ActivateAndServe()
+	<-started
+	return conn.LocalAddr().String(), nil
+}
+
+func (s *Server) handleDNSRequest(w dns.ResponseWriter, req *dns.Msg) {
+	msg := new(dns.Msg)
+	msg.SetReply(req)
+	msg.Authoritative = true
+	switch req.Opcode {
+	case dns.OpcodeQuery:
+		for _, q := range msg.Question {
+			if err := s.addDNSAnswer(q, msg, req); err != nil {
+				msg.SetRcode(req, dns.RcodeServerFailure)
+				break
+			}
+		}
+	}
+	w.WriteMsg(msg)
+}
+
+func (s *Server) addDNSAnswer(q dns.Question, msg *dns.Msg, req *dns.Msg) error {
+	switch q.Qtype {
+	// TXT records are the only important record for ACME dns-01 challenges
+	case dns.TypeTXT:
+		found := false
+		for _, record := range s.dnsRecords() {
+			if record.RecordType != "TXT" || !strings.EqualFold(dns.Fqdn(record.Name+"."+record.Domain), q.Name) {
+				continue
+			}
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN TXT %q", q.Name, record.Ttl, record.Data))
+			if err != nil {
+				return err
+			}
+			msg.Answer = append(msg.Answer, rr)
+			found = true
+		}
+		if !found {
+			msg.SetRcode(req, dns.RcodeNameError)
+		}
+		return nil
+
+	// CNAME records delegate challenges to another zone (added via AddRecord)
+	case dns.TypeCNAME:
+		found := false
+		for _, record := range s.dnsRecords() {
+			if record.RecordType != "CNAME" || !strings.EqualFold(dns.Fqdn(record.Name+"."+record.Domain), q.Name) {
+				continue
+			}
+			rr, err := dns.NewRR(fmt.Sprintf("%s %d IN CNAME %s", q.Name, record.Ttl, dns.Fqdn(record.Data)))
+			if err != nil {
+				return err
+			}
+			msg.Answer = append(msg.Answer, rr)
+			found = true
+		}
+		if !found {
+			msg.SetRcode(req, dns.RcodeNameError)
+		}
+		return nil
+
+	// NS and SOA are for authoritative lookups, return obviously invalid data - the name
+	// server's address is the local one, though
+	case dns.TypeNS:
+		rr, err := dns.NewRR(fmt.Sprintf("%s 5 IN NS %s", q.Name, NameServer))
+		if err != nil {
+			return err
+		}
+		msg.Answer = append(msg.Answer, rr)
+		return nil
+	case dns.TypeSOA:
+		rr, err := dns.NewRR(fmt.Sprintf("%s 5 IN SOA %s 20 5 5 5 5", NameServer, NameServer))
+		if err != nil {
+			return err
+		}
+		msg.Answer = append(msg.Answer, rr)
+		return nil
+	case dns.TypeA:
+		if !strings.EqualFold(q.Name, NameServer) {
+			msg.SetRcode(req, dns.RcodeNameError)
+			return nil
+		}
+		rr, err := dns.NewRR(fmt.Sprintf("%s 5 IN A 127.0.0.1", q.Name))
+		if err != nil {
+			return err
+		}
+		msg.Answer = append(msg.Answer, rr)
+		return nil
+	case dns.TypeAAAA:
+		if !strings.EqualFold(q.Name, NameServer) {
+			msg.SetRcode(req, dns.RcodeNameError)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unimplemented record type %v", q.Qtype)
+	}
+}
@@ -0,0 +1,67 @@
+package fakevariomedia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+func TestServer_DNS(t *testing.T) {
+	s := New()
+	addr, err := s.StartDNS()
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.AddRecord(Record{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "key1", Ttl: 300})
+	s.AddRecord(Record{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "key2", Ttl: 300})
+
+	msg := new(dns.Msg)
+	msg.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+	in, err := dns.Exchange(msg, addr)
+	require.NoError(t, err)
+	require.Len(t, in.Answer, 2, "RR response is of incorrect length")
+	assert.Equal(t, []string{"key1"}, in.Answer[0].(*dns.TXT).Txt)
+	assert.Equal(t, []string{"key2"}, in.Answer[1].(*dns.TXT).Txt)
+
+	msg.SetQuestion("_acme-challenge.example.org.", dns.TypeTXT)
+	in, err = dns.Exchange(msg, addr)
+	require.NoError(t, err)
+	assert.Len(t, in.Answer, 0, "RR response is of incorrect length")
+	assert.Equal(t, dns.RcodeNameError, in.Rcode, "Expected NXDOMAIN")
+
+	s.AddRecord(Record{RecordType: "CNAME", Name: "_acme-challenge", Domain: "example.net", Data: "_acme-challenge.example.com", Ttl: 300})
+	msg.SetQuestion("_acme-challenge.example.net.", dns.TypeCNAME)
+	in, err = dns.Exchange(msg, addr)
+	require.NoError(t, err)
+	require.Len(t, in.Answer, 1, "RR response is of incorrect length")
+	assert.Equal(t, "_acme-challenge.example.com.", in.Answer[0].(*dns.CNAME).Target)
+}
+
+func TestServer_DNSDelay(t *testing.T) {
+	s := New()
+	s.DNSDelay = 100 * time.Millisecond
+	addr, err := s.StartDNS()
+	require.NoError(t, err)
+	defer s.Close()
+
+	s.AddRecord(Record{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "key", Ttl: 300})
+	msg := new(dns.Msg)
+	msg.SetQuestion("_acme-challenge.example.com.", dns.TypeTXT)
+	in, err := dns.Exchange(msg, addr)
+	require.NoError(t, err)
+	assert.Equal(t, dns.RcodeNameError, in.Rcode, "record served before DNSDelay")
+
+	time.Sleep(s.DNSDelay)
+	in, err = dns.Exchange(msg, addr)
+	require.NoError(t, err)
+	assert.Len(t, in.Answer, 1, "RR response is of incorrect length")
+
+	msg.SetQuestion(NameServer, dns.TypeA)
+	in, err = dns.Exchange(msg, addr)
+	require.NoError(t, err)
+	require.Len(t, in.Answer, 1, "RR response is of incorrect length")
+	assert.Equal(t, "127.0.0.1", in.Answer[0].(*dns.A).A.String())
+}
@@ -0,0 +1,445 @@
+// package fakevariomedia contains an in-memory stand-in for the parts of the Variomedia
+// JSON:API (https://api.variomedia.de/docs/) used by the webhook, so that tests and local
+// development can run without a live Variomedia account. The stored records can be
+// served via DNS, too, mimicking Variomedia's authoritative name servers.
+package fakevariomedia
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+const (
+	// Variomedia rejects records with a TTL below this value
+	minTtl = 300
+	// content type of all JSON:API documents
+	contentType = "application/vnd.api+json"
+)
+
+// Record is a DNS record as stored by the fake server
+type Record struct {
+	Id         string
+	RecordType string
+	Name       string
+	Domain     string
+	Data       string
+	Ttl        int
+}
+
+// job is a queued change, which is applied once the job turns "done"
+type job struct {
+	id       string
+	polls    int
+	status   string
+	recordId string
+	apply    func()
+}
+
+// Server is a fake Variomedia API server. The zero value is not usable, create
+// instances via New().
+type Server struct {
+	// number of queue-job lookups that report "pending" before a job is done
+	PendingPolls int
+	// number of requests accepted per RateLimitWindow before answering with
+	// HTTP status 429; 0 disables rate limiting
+	RateLimit       int
+	RateLimitWindow time.Duration
+	// let jobs end with status "failed" instead of applying their change
+	FailJobs bool
+	// how long after being stored records are served via DNS, mimicking name servers
+	// lagging behind the API
+	DNSDelay time.Duration
+
+	tokens    map[string]bool
+	records   map[string]*Record
+	stored    map[string]time.Time
+	jobs      map[string]*job
+	nextId    int
+	requests  []time.Time
+	throttled int
+	limitHits int
+	server    *httptest.Server
+	dnsServer *dns.Server
+	sync.RWMutex
+}
+
+// New creates a fake server that accepts the given API tokens. Without any tokens,
+// every request is accepted.
+func New(tokens ...string) *Server {
+	s := &Server{
+		RateLimitWindow: time.Second,
+		tokens:          make(map[string]bool),
+		records:         make(map[string]*Record),
+		stored:          make(map[string]time.Time),
+		jobs:            make(map[string]*job),
+	}
+	for _, token := range tokens {
+		s.tokens[token] = true
+	}
+	return s
+}
+
+// NewTest creates a fake server like New and starts serving it for the test, which
+// closes it once finished
+func NewTest(t testing.TB, tokens ...string) *Server {
+	s := New(tokens...)
+	s.Start()
+	t.Cleanup(s.Close)
+	return s
+}
+
+// Start serves the fake API on a local port and returns its base URL
+func (s *Server) Start() string {
+	s.server = httptest.NewServer(s)
+	return s.server.URL
+}
+
+// Close stops serving the fake API and DNS
+func (s *Server) Close() {
+	if s.server != nil {
+		s.server.Close()
+	}
+	if s.dnsServer != nil {
+		s.dnsServer.Shutdown()
+	}
+}
+
+// URL returns the base URL of the started server
+func (s *Server) URL() string {
+	if s.server == nil {
+		return ""
+	}
+	return s.server.URL
+}
+
+// AddRecord stores a record right away, i.e. to simulate existing zone content,
+// and returns its ID
+func (s *Server) AddRecord(r Record) string {
+	s.Lock()
+	defer s.Unlock()
+	r.Id = s.newId()
+	s.store(&r)
+	return r.Id
+}
+
+// Records returns a copy of all records currently stored, ordered by ID
+func (s *Server) Records() []Record {
+	s.RLock()
+	defer s.RUnlock()
+	records := make([]Record, 0, len(s.records))
+	for _, r := range s.records {
+		records = append(records, *r)
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, _ := strconv.Atoi(records[i].Id)
+		b, _ := strconv.Atoi(records[j].Id)
+		return a < b
+	})
+	return records
+}
+
+// dnsRecords returns the records served via DNS, i.e. those stored at least DNSDelay ago
+func (s *Server) dnsRecords() []Record {
+	s.RLock()
+	defer s.RUnlock()
+	records := []Record{}
+	for _, r := range s.records {
+		if time.Since(s.stored[r.Id]) >= s.DNSDelay {
+			records = append(records, *r)
+		}
+	}
+	sort.Slice(records, func(i, j int) bool {
+		a, _ := strconv.Atoi(records[i].Id)
+		b, _ := strconv.Atoi(records[j].Id)
+		return a < b
+	})
+	return records
+}
+
+// Throttle makes the server answer the next n requests with HTTP status 429
+func (s *Server) Throttle(n int) {
+	s.Lock()
+	s.throttled = n
+	s.Unlock()
+}
+
+// RateLimitHits returns the number of requests answered with HTTP status 429 so far
+func (s *Server) RateLimitHits() int {
+	s.RLock()
+	defer s.RUnlock()
+	return s.limitHits
+}
+
+// ServeHTTP implements http.Handler
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if !s.authorized(r) {
+		writeError(w, http.StatusUnauthorized, "unauthorized", "Unauthorized", "missing or invalid API token")
+		return
+	}
+	if s.rateLimited() {
+		w.Header().Set("Retry-After", "1")
+		writeError(w, http.StatusTooManyRequests, "rate-limit", "Too Many Requests", "request limit reached")
+		return
+	}
+
+	path := strings.Trim(r.URL.Path, "/")
+	parts := strings.Split(path, "/")
+	switch {
+	case path == "dns-records" && r.Method == http.MethodPost:
+		s.createRecord(w, r)
+	case path == "dns-records" && r.Method == http.MethodGet:
+		s.listRecords(w, r)
+	case len(parts) == 2 && parts[0] == "dns-records" && r.Method == http.MethodGet:
+		s.getRecord(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "dns-records" && r.Method == http.MethodDelete:
+		s.deleteRecord(w, r, parts[1])
+	case len(parts) == 2 && parts[0] == "queue-jobs" && r.Method == http.MethodGet:
+		s.getJob(w, r, parts[1])
+	default:
+		writeError(w, http.StatusNotFound, "not-found", "Not Found", fmt.Sprintf("no route for %s %s", r.Method, r.URL.Path))
+	}
+}
+
+func (s *Server) authorized(r *http.Request) bool {
+	if len(s.tokens) == 0 {
+		return true
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "token ")
+	return s.tokens[token]
+}
+
+func (s *Server) rateLimited() bool {
+	s.Lock()
+	defer s.Unlock()
+	if s.throttled > 0 {
+		s.throttled--
+		s.limitHits++
+		return true
+	}
+	if s.RateLimit <= 0 {
+		return false
+	}
+	now := time.Now()
+	recent := s.requests[:0]
+	for _, t := range s.requests {
+		if now.Sub(t) < s.RateLimitWindow {
+			recent = append(recent, t)
+		}
+	}
+	s.requests = recent
+	if len(s.requests) >= s.RateLimit {
+		s.limitHits++
+		return true
+	}
+	s.requests = append(s.requests, now)
+	return false
+}
+
+type recordAttributes struct {
+	RecordType string `json:"record_type"`
+	Name       string `json:"name"`
+	Domain     string `json:"domain"`
+	Data       string `json:"data"`
+	Ttl        int    `json:"ttl"`
+}
+
+type resource struct {
+	Type       string            `json:"type"`
+	Id         string            `json:"id,omitempty"`
+	Attributes interface{}       `json:"attributes"`
+	Links      map[string]string `json:"links,omitempty"`
+}
+
+func (s *Server) createRecord(w http.ResponseWriter, r *http.Request) {
+	var req struct {
+		Data struct {
+			Type       string           `json:"type"`
+			Attributes recordAttributes `json:"attributes"`
+		} `json:"data"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		writeError(w, http.StatusBadRequest, "invalid-json", "Bad Request", err.Error())
+		return
+	}
+	attr := req.Data.Attributes
+	switch {
+	case req.Data.Type != "dns-record":
+		writeError(w, http.StatusUnprocessableEntity, "invalid-type", "Unprocessable Entity", "type must be dns-record")
+		return
+	case attr.RecordType == "" || attr.Name == "" || attr.Domain == "" || attr.Data == "":
+		writeError(w, http.StatusUnprocessableEntity, "missing-attribute", "Unprocessable Entity", "record_type, name, domain and data are required")
+		return
+	case attr.Ttl < minTtl:
+		writeError(w, http.StatusUnprocessableEntity, "invalid-ttl", "Unprocessable Entity", fmt.Sprintf("ttl must be at least %d", minTtl))
+		return
+	}
+
+	s.Lock()
+	record := &Record{
+		Id:         s.newId(),
+		RecordType: attr.RecordType,
+		Name:       attr.Name,
+		Domain:     attr.Domain,
+		Data:       attr.Data,
+		Ttl:        attr.Ttl,
+	}
+	j := s.newJob(record.Id, func() { s.store(record) })
+	s.Unlock()
+
+	writeJob(w, r, http.StatusAccepted, j)
+}
+
+func (s *Server) listRecords(w http.ResponseWriter, r *http.Request) {
+	domain := r.URL.Query().Get("filter[domain]")
+	data := []resource{}
+	for _, record := range s.Records() {
+		if domain != "" && !strings.EqualFold(record.Domain, domain) {
+			continue
+		}
+		data = append(data, recordResource(r, &record))
+	}
+	writeDocument(w, http.StatusOK, map[string]interface{}{
+		"data":  data,
+		"links": map[string]string{"self": baseUrl(r) + r.URL.RequestURI()},
+	})
+}
+
+func (s *Server) getRecord(w http.ResponseWriter, r *http.Request, id string) {
+	s.RLock()
+	record, found := s.records[id]
+	s.RUnlock()
+	if !found {
+		writeError(w, http.StatusNotFound, "not-found", "Not Found", fmt.Sprintf("dns-record %s not found", id))
+		return
+	}
+	writeDocument(w, http.StatusOK, map[string]interface{}{"data": recordResource(r, record)})
+}
+
+func (s *Server) deleteRecord(w http.ResponseWriter, r *http.Request, id string) {
+	s.Lock()
+	if _, found := s.records[id]; !found {
+		s.Unlock()
+		writeError(w, http.StatusNotFound, "not-found", "Not Found", fmt.Sprintf("dns-record %s not found", id))
+		return
+	}
+	j := s.newJob(id, func() { delete(s.records, id) })
+	s.Unlock()
+
+	writeJob(w, r, http.StatusAccepted, j)
+}
+
+func (s *Server) getJob(w http.ResponseWriter, r *http.Request, id string) {
+	s.Lock()
+	j, found := s.jobs[id]
+	if found {
+		j.polls++
+		s.advance(j)
+	}
+	s.Unlock()
+	if !found {
+		writeError(w, http.StatusNotFound, "not-found", "Not Found", fmt.Sprintf("queue-job %s not found", id))
+		return
+	}
+	writeJob(w, r, http.StatusOK, j)
+}
+
+// newJob queues a change; must be called with the lock held
+func (s *Server) newJob(recordId string, apply func()) *job {
+	j := &job{
+		id:       s.newId(),
+		status:   "pending",
+		recordId: recordId,
+		apply:    apply,
+	}
+	s.jobs[j.id] = j
+	s.advance(j)
+	return j
+}
+
+// advance completes (or fails) a pending job once it was polled often enough; must be called
+// with the lock held
+func (s *Server) advance(j *job) {
+	if j.status == "pending" && j.polls >= s.PendingPolls {
+		if s.FailJobs {
+			j.status = "failed"
+			return
+		}
+		j.apply()
+		j.status = "done"
+	}
+}
+
+// store adds a record; must be called with the lock held
+func (s *Server) store(r *Record) {
+	s.records[r.Id] = r
+	s.stored[r.Id] = time.Now()
+}
+
+// newId returns a new unique ID; must be called with the lock held
+func (s *Server) newId() string {
+	s.nextId++
+	return strconv.Itoa(s.nextId)
+}
+
+func baseUrl(r *http.Request) string {
+	if r.TLS != nil {
+		return "https://" + r.Host
+	}
+	return "http://" + r.Host
+}
+
+func recordResource(r *http.Request, record *Record) resource {
+	return resource{
+		Type: "dns-record",
+		Id:   record.Id,
+		Attributes: recordAttributes{
+			RecordType: record.RecordType,
+			Name:       record.Name,
+			Domain:     record.Domain,
+			Data:       record.Data,
+			Ttl:        record.Ttl,
+		},
+		Links: map[string]string{"self": baseUrl(r) + "/dns-records/" + record.Id},
+	}
+}
+
+func writeJob(w http.ResponseWriter, r *http.Request, status int, j *job) {
+	writeDocument(w, status, map[string]interface{}{
+		"data": resource{
+			Type:       "queue-job",
+			Id:         j.id,
+			Attributes: map[string]string{"status": j.status},
+			Links: map[string]string{
+				"queue-job":  baseUrl(r) + "/queue-jobs/" + j.id,
+				"dns-record": baseUrl(r) + "/dns-records/" + j.recordId,
+			},
+		},
+	})
+}
+
+func writeError(w http.ResponseWriter, status int, code, title, detail string) {
+	writeDocument(w, status, map[string]interface{}{
+		"errors": []map[string]string{{
+			"status": strconv.Itoa(status),
+			"code":   code,
+			"title":  title,
+			"detail": detail,
+		}},
+	})
+}
+
+func writeDocument(w http.ResponseWriter, status int, doc interface{}) {
+	w.Header().Set("Content-Type", contentType)
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(doc)
+}
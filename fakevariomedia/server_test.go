@@ -0,0 +1,123 @@
+package fakevariomedia
+
+import (
+	"encoding/json"
+	"net/http"
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+)
+
+type document struct {
+	Data struct {
+		Id         string            `json:"id"`
+		Attributes map[string]string `json:"attributes"`
+		Links      map[string]string `json:"links"`
+	} `json:"data"`
+	Errors []map[string]string `json:"errors"`
+}
+
+func doRequest(t *testing.T, method, url, token, body string) (int, document) {
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	require.NoError(t, err)
+	req.Header.Set("Authorization", "token "+token)
+	res, err := http.DefaultClient.Do(req)
+	require.NoError(t, err)
+	defer res.Body.Close()
+
+	var doc document
+	json.NewDecoder(res.Body).Decode(&doc)
+	return res.StatusCode, doc
+}
+
+const createBody = `{"data": {"type": "dns-record", "attributes": {"record_type": "TXT", "name": "_acme-challenge", "domain": "example.com", "data": "key", "ttl": 300}}}`
+
+func TestServer_CreateAndDelete(t *testing.T) {
+	s := NewTest(t, "secret")
+	s.PendingPolls = 2
+	url := s.URL()
+
+	status, doc := doRequest(t, http.MethodPost, url+"/dns-records", "secret", createBody)
+	assert.Equal(t, http.StatusAccepted, status)
+	assert.Equal(t, "pending", doc.Data.Attributes["status"])
+	assert.Empty(t, s.Records(), "record must not exist before the job is done")
+
+	jobUrl, recordUrl := doc.Data.Links["queue-job"], doc.Data.Links["dns-record"]
+	_, doc = doRequest(t, http.MethodGet, jobUrl, "secret", "")
+	assert.Equal(t, "pending", doc.Data.Attributes["status"])
+	_, doc = doRequest(t, http.MethodGet, jobUrl, "secret", "")
+	assert.Equal(t, "done", doc.Data.Attributes["status"])
+
+	records := s.Records()
+	require.Len(t, records, 1)
+	assert.Equal(t, "key", records[0].Data)
+	assert.Equal(t, url+"/dns-records/"+records[0].Id, recordUrl)
+
+	status, _ = doRequest(t, http.MethodGet, recordUrl, "secret", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	status, doc = doRequest(t, http.MethodDelete, recordUrl, "secret", "")
+	assert.Equal(t, http.StatusAccepted, status)
+	jobUrl = doc.Data.Links["queue-job"]
+	doRequest(t, http.MethodGet, jobUrl, "secret", "")
+	doRequest(t, http.MethodGet, jobUrl, "secret", "")
+	assert.Empty(t, s.Records())
+
+	status, doc = doRequest(t, http.MethodDelete, recordUrl, "secret", "")
+	assert.Equal(t, http.StatusNotFound, status)
+	require.Len(t, doc.Errors, 1)
+	assert.Equal(t, "404", doc.Errors[0]["status"])
+}
+
+func TestServer_ListRecords(t *testing.T) {
+	s := NewTest(t)
+	url := s.URL()
+
+	s.AddRecord(Record{RecordType: "TXT", Name: "a", Domain: "example.com", Data: "1", Ttl: 300})
+	s.AddRecord(Record{RecordType: "TXT", Name: "b", Domain: "example.org", Data: "2", Ttl: 300})
+
+	res, err := http.Get(url + "/dns-records?filter[domain]=example.com")
+	require.NoError(t, err)
+	defer res.Body.Close()
+	var list struct {
+		Data []struct {
+			Id         string            `json:"id"`
+			Attributes recordAttributes  `json:"attributes"`
+			Links      map[string]string `json:"links"`
+		} `json:"data"`
+	}
+	require.NoError(t, json.NewDecoder(res.Body).Decode(&list))
+	require.Len(t, list.Data, 1)
+	assert.Equal(t, "a", list.Data[0].Attributes.Name)
+	assert.Equal(t, url+"/dns-records/"+list.Data[0].Id, list.Data[0].Links["self"])
+}
+
+func TestServer_Errors(t *testing.T) {
+	s := NewTest(t, "secret")
+	url := s.URL()
+
+	status, _ := doRequest(t, http.MethodPost, url+"/dns-records", "wrong", createBody)
+	assert.Equal(t, http.StatusUnauthorized, status)
+
+	status, doc := doRequest(t, http.MethodPost, url+"/dns-records", "secret", strings.Replace(createBody, "300", "60", 1))
+	assert.Equal(t, http.StatusUnprocessableEntity, status)
+	require.Len(t, doc.Errors, 1)
+	assert.Equal(t, "invalid-ttl", doc.Errors[0]["code"])
+
+	status, _ = doRequest(t, http.MethodGet, url+"/queue-jobs/4711", "secret", "")
+	assert.Equal(t, http.StatusNotFound, status)
+
+	s.Throttle(1)
+	status, _ = doRequest(t, http.MethodGet, url+"/dns-records", "secret", "")
+	assert.Equal(t, http.StatusTooManyRequests, status)
+	status, _ = doRequest(t, http.MethodGet, url+"/dns-records", "secret", "")
+	assert.Equal(t, http.StatusOK, status)
+
+	s.RateLimit = 1
+	status, _ = doRequest(t, http.MethodGet, url+"/dns-records", "secret", "")
+	assert.Equal(t, http.StatusOK, status)
+	status, _ = doRequest(t, http.MethodGet, url+"/dns-records", "secret", "")
+	assert.Equal(t, http.StatusTooManyRequests, status)
+}
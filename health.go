@@ -0,0 +1,235 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// health and readiness endpoints
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+const (
+	// how often the readiness checks run
+	defaultReadinessCheckInterval = time.Minute
+	// maximum duration of all readiness checks together
+	readinessCheckTimeout = 10 * time.Second
+	// API keys not used by any challenge for this long are no longer checked
+	recentApiKeyMaxAge = 24 * time.Hour
+
+	healthzPath = "/healthz"
+	readyzPath  = "/readyz"
+
+	// names of the readiness checks - API keys are checked per domain
+	checkVariomediaApi = "variomedia-api"
+	checkApiKeyPrefix  = "api-key:"
+
+	healthOk      = "ok"
+	healthFailed  = "failed"
+	healthPending = "pending"
+)
+
+// checkResult is the outcome of a single readiness check
+type checkResult struct {
+	Status    string    `json:"status"`
+	Error     string    `json:"error,omitempty"`
+	CheckedAt time.Time `json:"checkedAt"`
+}
+
+// healthReport is served by the health and readiness endpoints
+type healthReport struct {
+	Status string                 `json:"status"`
+	Checks map[string]checkResult `json:"checks,omitempty"`
+}
+
+// recentApiKey is an API key used by a recent challenge, with what is needed to check it
+type recentApiKey struct {
+	apiKey   variomediaApiKey
+	domain   string
+	settings variomediaSettings
+	lastUsed time.Time
+}
+
+// readinessChecker checks whether the webhook is able to solve challenges: the Variomedia
+// API has to answer, and the API keys used by recent challenges have to be accepted. As
+// a rejected key only affects the challenges of its domains, it can be reported without
+// turning the webhook unready instead.
+// The checks run in the background once per interval, so probes only get the most
+// recent results and never cause API requests.
+type readinessChecker struct {
+	sync.Mutex
+	solver   *customDNSProviderSolver
+	interval time.Duration
+	// whether a rejected API key turns the webhook unready
+	failOnRejectedKey bool
+	keys              map[[sha256.Size]byte]recentApiKey
+	// results of the most recent checks, nil before the first checks finished
+	results map[string]checkResult
+	// signalled when the checks should run before the interval is over
+	recheck chan struct{}
+}
+
+// newReadinessChecker creates a readiness checker for the solver, running the checks once
+// per interval
+func newReadinessChecker(solver *customDNSProviderSolver, interval time.Duration, failOnRejectedKey bool) *readinessChecker {
+	return &readinessChecker{
+		solver:            solver,
+		interval:          interval,
+		failOnRejectedKey: failOnRejectedKey,
+		keys:              make(map[[sha256.Size]byte]recentApiKey),
+		recheck:           make(chan struct{}, 1),
+	}
+}
+
+// apiKeyUsed notes that a challenge of the domain used the API key, so the key is
+// checked from now on
+func (r *readinessChecker) apiKeyUsed(domain string, apiKey variomediaApiKey, settings variomediaSettings) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.keys[apiKey.hash()]; !ok {
+		// a new key deserves a check before the interval is over
+		r.requestRecheck()
+	}
+	r.keys[apiKey.hash()] = recentApiKey{apiKey: apiKey, domain: domain, settings: settings, lastUsed: time.Now()}
+}
+
+// forgetApiKey stops checking the API key, i.e. when it was replaced
+func (r *readinessChecker) forgetApiKey(apiKey variomediaApiKey) {
+	if r == nil {
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.keys[apiKey.hash()]; ok {
+		delete(r.keys, apiKey.hash())
+		r.requestRecheck()
+	}
+}
+
+// requestRecheck makes run() check again without waiting for the interval
+func (r *readinessChecker) requestRecheck() {
+	select {
+	case r.recheck <- struct{}{}:
+	default:
+	}
+}
+
+// run runs the checks right away, then once per interval (or when requested) until
+// stopCh is closed
+func (r *readinessChecker) run(stopCh <-chan struct{}) {
+	parent := r.solver.ctx
+	if parent == nil {
+		parent = context.Background()
+	}
+	ticker := time.NewTicker(r.interval)
+	defer ticker.Stop()
+	for {
+		ctx, cancel := context.WithTimeout(parent, readinessCheckTimeout)
+		r.check(ctx)
+		cancel()
+
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		case <-r.recheck:
+		}
+	}
+}
+
+// check runs the readiness checks and keeps their results. Results of checks cancelled
+// (i.e. as the webhook is stopping) are discarded, the previous results remain.
+func (r *readinessChecker) check(ctx context.Context) {
+	r.Lock()
+	var keys []recentApiKey
+	for hash, key := range r.keys {
+		if time.Since(key.lastUsed) > recentApiKeyMaxAge {
+			delete(r.keys, hash)
+			continue
+		}
+		keys = append(keys, key)
+	}
+	r.Unlock()
+
+	klog.V(4).InfoS("running readiness checks", "API keys", len(keys))
+	results := make(map[string]checkResult)
+	results[checkVariomediaApi] = newCheckResult(r.solver.newVariomediaClient(variomediaApiKey{}, variomediaSettings{}).Ping(ctx))
+
+	// a key used for several domains is checked once, for the domain it was used for last
+	for _, key := range keys {
+		err := r.solver.newVariomediaClient(key.apiKey, key.settings).CheckApiKey(ctx, &key.domain)
+		if err != nil {
+			err = explainVariomediaError(err, key.domain)
+		}
+		results[checkApiKeyPrefix+key.domain] = newCheckResult(err)
+	}
+
+	if errors.Is(ctx.Err(), context.Canceled) {
+		klog.V(4).InfoS("readiness checks cancelled, keeping previous results")
+		return
+	}
+	r.Lock()
+	defer r.Unlock()
+	r.results = results
+}
+
+// newCheckResult reports the outcome of a check
+func newCheckResult(err error) checkResult {
+	result := checkResult{Status: healthOk, CheckedAt: time.Now()}
+	if err != nil {
+		result.Status = healthFailed
+		result.Error = err.Error()
+	}
+	return result
+}
+
+// serveReadyz reports the results of the most recent readiness checks, with HTTP status
+// 503 if the Variomedia API didn't answer, a recently used API key was rejected (unless
+// disabled) or the checks didn't run yet
+func (r *readinessChecker) serveReadyz(w http.ResponseWriter, req *http.Request) {
+	r.Lock()
+	report := healthReport{Status: healthOk, Checks: r.results}
+	r.Unlock()
+
+	code := http.StatusOK
+	if report.Checks == nil {
+		report.Status = healthPending
+		code = http.StatusServiceUnavailable
+	}
+	for name, result := range report.Checks {
+		if result.Status == healthOk {
+			continue
+		}
+		klog.V(2).InfoS("readiness check failed", "check", name, "error", result.Error)
+		if name == checkVariomediaApi || r.failOnRejectedKey {
+			report.Status = healthFailed
+			code = http.StatusServiceUnavailable
+		}
+	}
+	writeHealthReport(w, code, report)
+}
+
+// serveHealthz reports that the webhook's process is alive
+func serveHealthz(w http.ResponseWriter, req *http.Request) {
+	writeHealthReport(w, http.StatusOK, healthReport{Status: healthOk})
+}
+
+func writeHealthReport(w http.ResponseWriter, code int, report healthReport) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	if err := json.NewEncoder(w).Encode(report); err != nil {
+		klog.ErrorS(err, "unable to write health report")
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+// getHealthReport calls the handler and decodes its report
+func getHealthReport(t *testing.T, handler http.HandlerFunc, path string) (int, healthReport) {
+	rec := httptest.NewRecorder()
+	handler(rec, httptest.NewRequest(http.MethodGet, path, nil))
+	assert.Equal(t, "application/json", rec.Header().Get("Content-Type"))
+	var report healthReport
+	require.NoError(t, json.Unmarshal(rec.Body.Bytes(), &report))
+	return rec.Code, report
+}
+
+func TestServeHealthz(t *testing.T) {
+	code, report := getHealthReport(t, serveHealthz, healthzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthOk, report.Status)
+}
+
+func TestServeReadyz(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	solver.readiness = newReadinessChecker(solver, time.Hour, true)
+
+	// unready until checked
+	code, report := getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthPending, report.Status)
+
+	// without challenges, only the API endpoint is checked
+	solver.readiness.check(context.Background())
+	code, report = getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthOk, report.Status)
+	assert.Len(t, report.Checks, 1)
+	assert.Equal(t, healthOk, report.Checks[checkVariomediaApi].Status)
+
+	// API keys used by challenges are checked from then on
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	require.NoError(t, solver.Present(ch))
+	require.NoError(t, solver.CleanUp(ch))
+	solver.readiness.check(context.Background())
+	code, report = getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthOk, report.Checks[checkApiKeyPrefix+"example.com"].Status)
+
+	// a key no longer accepted fails its check and turns the webhook unready
+	rejecting := fakevariomedia.NewTest(t, "another-token")
+	solver.apiBaseUrl = rejecting.URL()
+	solver.readiness.check(context.Background())
+	code, report = getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthFailed, report.Status)
+	assert.Equal(t, healthOk, report.Checks[checkVariomediaApi].Status)
+	result := report.Checks[checkApiKeyPrefix+"example.com"]
+	assert.Equal(t, healthFailed, result.Status)
+	assert.Contains(t, result.Error, "API key configured for domain 'example.com' was rejected")
+
+	// ... unless only the Variomedia API is to affect readiness
+	solver.readiness.failOnRejectedKey = false
+	code, report = getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Equal(t, healthOk, report.Status)
+	assert.Equal(t, healthFailed, report.Checks[checkApiKeyPrefix+"example.com"].Status)
+	solver.readiness.failOnRejectedKey = true
+
+	// ... and is no longer checked once replaced
+	solver.apiKeyRotated(types.NamespacedName{Namespace: "default", Name: "variomedia-credentials"}, "api-token", "fake-api-token\n")
+	solver.readiness.check(context.Background())
+	code, report = getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.Len(t, report.Checks, 1)
+
+	// an unreachable API turns the webhook unready
+	rejecting.Close()
+	solver.readiness.check(context.Background())
+	code, report = getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+	assert.Equal(t, http.StatusServiceUnavailable, code)
+	assert.Equal(t, healthFailed, report.Status)
+	assert.Equal(t, healthFailed, report.Checks[checkVariomediaApi].Status)
+}
+
+func TestReadinessChecker_Cancelled(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	solver.readiness = newReadinessChecker(solver, time.Hour, true)
+	solver.readiness.check(context.Background())
+	_, report := getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+	checkedAt := report.Checks[checkVariomediaApi].CheckedAt
+
+	// results of cancelled checks are discarded
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	solver.readiness.check(ctx)
+	code, report := getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+	assert.Equal(t, http.StatusOK, code)
+	assert.True(t, checkedAt.Equal(report.Checks[checkVariomediaApi].CheckedAt))
+}
+
+func TestReadinessChecker_Run(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	solver.readiness = newReadinessChecker(solver, time.Hour, true)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	go solver.readiness.run(stopCh)
+
+	// the checks run right away ...
+	assert.Eventually(t, func() bool {
+		code, _ := getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+		return code == http.StatusOK
+	}, 5*time.Second, 10*time.Millisecond)
+
+	// ... and again for a new API key, before the interval is over
+	solver.readiness.apiKeyUsed("example.com", newVariomediaApiKey("fake-api-token"), variomediaSettings{})
+	assert.Eventually(t, func() bool {
+		_, report := getHealthReport(t, solver.readiness.serveReadyz, readyzPath)
+		return report.Checks[checkApiKeyPrefix+"example.com"].Status == healthOk
+	}, 5*time.Second, 10*time.Millisecond)
+}
@@ -16,28 +16,63 @@
 package main
 
 import (
-	"encoding/json"
 	"fmt"
+	"net/http"
+	"net/url"
 	"os"
 	"context"
+	"strconv"
 	"strings"
+	"time"
 
 	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	"k8s.io/client-go/dynamic"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/rest"
+	"golang.org/x/time/rate"
 	"k8s.io/klog/v2"
 
 	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"github.com/jetstack/cert-manager/pkg/acme/webhook/cmd"
+	corev1 "k8s.io/api/core/v1"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
 )
 
 var GroupName = os.Getenv("GROUP_NAME")
-// our DNS entry URL cache: by client domain, by entry name, by key value
-var DnsEntryURL map[string]map[string]map[string]string
 
 const (
 	variomediaMinTtl = 300 // variomedia reports an error for values < this value
+	// maximum duration of a single Present() or CleanUp() call, matching the default
+	// request timeout of the Kubernetes API server
+	defaultChallengeTimeout = 60 * time.Second
+)
+
+// environment variables to adjust how the webhook talks to the Variomedia API
+const (
+	envApiUrl = "VARIOMEDIA_API_URL"         // API endpoint, i.e. a local stand-in for testing
+	envApiTimeout = "VARIOMEDIA_API_TIMEOUT" // timeout per HTTP request, as Go duration (i.e. "30s")
+	envApiProxy = "VARIOMEDIA_API_PROXY"     // HTTP(S) proxy to use, overriding HTTPS_PROXY & co.
+	envChallengeTimeout = "VARIOMEDIA_CHALLENGE_TIMEOUT" // maximum duration of a Present() or CleanUp() call
+	envJobPollInterval = "VARIOMEDIA_JOB_POLL_INTERVAL" // initial delay between DNS job status lookups
+	envJobPollMaxInterval = "VARIOMEDIA_JOB_POLL_MAX_INTERVAL" // maximum delay between DNS job status lookups
+	envJobTimeout = "VARIOMEDIA_JOB_TIMEOUT" // maximum time to wait for a DNS job to finish
+	envApiRateLimit = "VARIOMEDIA_API_RATE_LIMIT" // requests per second and API key
+	envApiRateBurst = "VARIOMEDIA_API_RATE_BURST" // burst size of requests per API key
+	envSecretNamespaces = "VARIOMEDIA_SECRET_NAMESPACES" // comma-separated namespaces secrets may be referenced from, "*" for all
+	envDnsServers = "VARIOMEDIA_DNS_SERVERS" // comma-separated name servers for DNS lookups, instead of those from /etc/resolv.conf
+	envMetricsAddress = "VARIOMEDIA_METRICS_ADDRESS" // listen address for serving Prometheus metrics (i.e. ":9402"), none if unset
+	envReadinessCheckInterval = "VARIOMEDIA_READINESS_CHECK_INTERVAL" // how often the readiness checks run
+	envReadinessFailOnRejectedKey = "VARIOMEDIA_READINESS_FAIL_ON_REJECTED_KEY" // "false" to keep the webhook ready while a recently used API key is rejected
+	envOtlpEndpoint = "VARIOMEDIA_OTLP_ENDPOINT" // OTLP/HTTP collector to export traces to (i.e. "http://otel-collector:4318"), none if unset
+	envAuditSinks = "VARIOMEDIA_AUDIT_SINKS" // comma-separated audit log sinks: "stdout", "file:<path>" or http(s) URLs, none if unset
+	envAuditFileMaxSize = "VARIOMEDIA_AUDIT_FILE_MAX_SIZE" // size in megabytes an audit log file is rotated at
+	envAuditFileMaxBackups = "VARIOMEDIA_AUDIT_FILE_MAX_BACKUPS" // number of rotated audit log files kept
+	envSweepInterval = "VARIOMEDIA_SWEEP_INTERVAL" // how often to delete orphaned challenge records, as Go duration - not swept if unset
+	envSweepMinAge = "VARIOMEDIA_SWEEP_MIN_AGE" // how long a challenge record has to be orphaned before it is deleted
+	envSweepDryRun = "VARIOMEDIA_SWEEP_DRY_RUN" // "true" to only report orphaned challenge records instead of deleting them
+	envSweepMaxDeletions = "VARIOMEDIA_SWEEP_MAX_DELETIONS" // maximum number of challenge records deleted per sweep
+	envSweepStateConfigMap = "VARIOMEDIA_SWEEP_STATE_CONFIGMAP" // <namespace>/<name> of the ConfigMap keeping the sweeper's state across restarts
 )
 
 func main() {
@@ -48,8 +83,6 @@ func main() {
 		panic("GROUP_NAME must be specified")
 	}
 
-	DnsEntryURL = make(map[string]map[string]map[string]string)
-
 	// This will register our custom DNS provider with the webhook serving
 	// library, making it available as an API under the provided GroupName.
 	// You can register multiple DNS provider implementations with a single
@@ -66,7 +99,35 @@ func main() {
 // To do so, it must implement the `github.com/jetstack/cert-manager/pkg/acme/webhook.Solver`
 // interface.
 type customDNSProviderSolver struct {
-	client kubernetes.Clientset
+	client kubernetes.Interface
+	// our DNS entry URL cache, shared by concurrent Present() and CleanUp() calls
+	entries dnsEntryCache
+	// Variomedia API endpoint - empty for the live API
+	apiBaseUrl string
+	// HTTP client shared by all Variomedia API clients
+	httpClient *http.Client
+	// how to wait for Variomedia's DNS jobs - zero value for the client's defaults
+	jobWaiter variomediaJobWaiter
+	// token buckets shared by all requests per API key - nil for no client-side limit
+	rateLimiters *apiKeyRateLimiters
+	// cancelled when the webhook is shut down, aborting all pending Variomedia requests
+	ctx context.Context
+	// maximum duration of a single Present() or CleanUp() call
+	challengeTimeout time.Duration
+	// namespaces (other than the challenge's own) secrets may be read from
+	secretNamespaces namespaceAllowList
+	// watch-based cache of the referenced secrets - nil to read them directly
+	secrets *secretCache
+	// for looking up the CNAMEs of delegated challenges
+	resolver *dnsResolver
+	// checks behind the readiness endpoint - nil if not served
+	readiness *readinessChecker
+	// tamper-evident record of all changed TXT records - nil if not kept
+	audit *auditLog
+	// records the progress on the Challenge resources - nil if not recorded
+	events *challengeEvents
+	// deletes orphaned challenge records - nil if not swept
+	sweeper *recordSweeper
 }
 
 // customDNSProviderConfig is a structure that is used to decode into when
@@ -74,7 +135,18 @@ type customDNSProviderSolver struct {
 // This information is provided by cert-manager, and may be a reference to
 // additional configuration that's needed to solve the challenge for this
 // particular certificate or issuer.
-type customDNSProviderConfig map[string]string
+// See config.go for the supported formats.
+type customDNSProviderConfig struct {
+	Version  int                               `json:"version"`
+	Defaults variomediaSettings                `json:"defaults"`
+	// the Variomedia domains, including validation zones challenges are delegated to
+	Domains  map[string]variomediaDomainConfig `json:"domains"`
+	// challenged domains hosted elsewhere, mapped to the name within a Variomedia domain
+	// their challenges are delegated to via CNAME
+	Aliases  map[string]string                 `json:"aliases,omitempty"`
+	// follow the CNAME of challenged names not within any domain or alias
+	FollowCNAME bool                           `json:"followCNAME,omitempty"`
+}
 
 // Name is used as the name for this DNS solver when referencing it on the ACME
 // Issuer resource.
@@ -104,11 +176,118 @@ func (c *customDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stop
 		return err
 	}
 
-	if DnsEntryURL == nil {
-		DnsEntryURL = make(map[string]map[string]map[string]string)
+	c.client = cl
+	c.secrets = newSecretCache(cl, stopCh, c.apiKeyRotated)
+
+	// Challenges are watched to record events on them and to spare their records when sweeping
+	challengeClient, err := dynamic.NewForConfig(kubeClientConfig)
+	if err != nil {
+		klog.ErrorS( err, "Initialize() finished with error while creating the challenge client")
+		return err
+	}
+	challenges, err := newChallengeStore(challengeClient, stopCh)
+	if err != nil {
+		klog.ErrorS( err, "Initialize() finished with error while watching challenges")
+		return err
+	}
+	c.events = newClusterChallengeEvents(challenges, cl, stopCh)
+
+	c.sweeper, err = recordSweeperFromEnv(c, challenges, cl)
+	if err != nil {
+		klog.ErrorS( err, "Initialize() finished with error while reading sweeper settings")
+		return err
+	}
+
+	// pending requests are cancelled once the webhook is told to stop
+	ctx, cancel := context.WithCancel(context.Background())
+	go func() {
+		<-stopCh
+		klog.V(2).InfoS( "webhook is stopping, cancelling pending Variomedia requests")
+		cancel()
+	}()
+	c.ctx = ctx
+
+	c.challengeTimeout, err = durationFromEnv(envChallengeTimeout, defaultChallengeTimeout)
+	if err != nil {
+		klog.ErrorS( err, "Initialize() finished with error while reading challenge timeout")
+		return err
+	}
+
+	c.jobWaiter, err = jobWaiterFromEnv()
+	if err != nil {
+		klog.ErrorS( err, "Initialize() finished with error while reading DNS job settings")
+		return err
+	}
+
+	c.rateLimiters, err = rateLimitersFromEnv()
+	if err != nil {
+		klog.ErrorS( err, "Initialize() finished with error while reading rate limit settings")
+		return err
+	}
+
+	c.secretNamespaces = namespaceAllowListFromEnv()
+
+	// the resolver is only needed to follow CNAMEs, so its absence is no reason to fail
+	c.resolver, err = dnsResolverFromEnv()
+	if err != nil {
+		klog.ErrorS( err, "unable to set up DNS resolver, following CNAMEs is not available")
+	}
+
+	readinessCheckInterval, err := durationFromEnv(envReadinessCheckInterval, defaultReadinessCheckInterval)
+	if err != nil {
+		klog.ErrorS( err, "Initialize() finished with error while reading readiness check interval")
+		return err
+	}
+	failOnRejectedKey := true
+	if value := os.Getenv( envReadinessFailOnRejectedKey); value != "" {
+		failOnRejectedKey, err = strconv.ParseBool( value)
+		if err != nil {
+			err = fmt.Errorf( "invalid %s `%s`: must be true or false", envReadinessFailOnRejectedKey, value)
+			klog.ErrorS( err, "Initialize() finished with error while reading readiness settings")
+			return err
+		}
+	}
+
+	// metrics and health endpoints are served on a port of their own, if at all
+	if address := os.Getenv( envMetricsAddress); address != "" {
+		c.readiness = newReadinessChecker( c, readinessCheckInterval, failOnRejectedKey)
+		err = c.serveMetrics( address, stopCh)
+		if err != nil {
+			klog.ErrorS( err, "Initialize() finished with error while starting the metrics server")
+			return err
+		}
+	}
+
+	if endpoint := os.Getenv( envOtlpEndpoint); endpoint != "" {
+		err = setupTracing( endpoint, stopCh)
+		if err != nil {
+			klog.ErrorS( err, "Initialize() finished with error while setting up tracing")
+			return err
+		}
+	}
+
+	c.audit, err = auditLogFromEnv( stopCh)
+	if err != nil {
+		klog.ErrorS( err, "Initialize() finished with error while setting up the audit log")
+		return err
+	}
+
+	// a pre-set HTTP client (i.e. from tests) takes precedence over the environment
+	if c.httpClient == nil {
+		c.apiBaseUrl, c.httpClient, err = apiSettingsFromEnv()
+		if err != nil {
+			klog.ErrorS( err, "Initialize() finished with error while reading API settings")
+			return err
+		}
 	}
 
-	c.client = *cl
+	// readiness checks and sweeps run in the background, once the API settings are known
+	if c.readiness != nil {
+		go c.readiness.run( stopCh)
+	}
+	if c.sweeper != nil {
+		go c.sweeper.run( stopCh)
+	}
 
 	klog.V(4).Infof( "Initialize() finished")
 	return nil
@@ -119,88 +298,382 @@ func (c *customDNSProviderSolver) Initialize(kubeClientConfig *rest.Config, stop
 // This method should tolerate being called multiple times with the same value.
 // cert-manager itself will later perform a self check to ensure that the
 // solver has correctly configured the DNS provider.
-func (c *customDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) error {
+func (c *customDNSProviderSolver) Present(ch *v1alpha1.ChallengeRequest) (err error) {
 	klog.V(4).InfoS( "Present() called")
 	klog.V(5).InfoS("parameters", "challenge", ch)
 
-	cfg, err := c.loadApiKeys(ch.Config, ch.ResourceNamespace)
+	// the domain is known once the configuration was evaluated
+	domain := ""
+	defer func( start time.Time) {
+		observeChallenge( operationPresent, domain, start, err)
+	}( time.Now())
+
+	ctx, cancel := c.challengeContext()
+	defer cancel()
+	ctx, span := startSpan( ctx, "Present", attrFqdn.String( ch.ResolvedFQDN), attrZone.String( ch.ResolvedZone))
+	defer func() {
+		endSpan( span, err)
+	}()
+
+	cfg, err := loadConfig( ch.Config)
 	if err != nil {
-		klog.ErrorS( err, "Present() finished with error while loading API keys")
+		klog.ErrorS( err, "Present() finished with error while loading configuration")
 		return err
 	}
         klog.V(6).Infof("decoded configuration %v", cfg)
 
-        entry, domain, apiKey, err := c.getDomainAndEntryAndApiKey( ch, &cfg)
+	// in DNS alias mode, the record is created where the challenged name points to
+	fqdn, err := c.challengeFqdn( ctx, ch, &cfg)
+	if err != nil {
+		klog.ErrorS( err, "Present() finished with error while resolving the challenged name")
+		return fmt.Errorf("unable to determine TXT record for %s: %v", ch.ResolvedFQDN, err)
+	}
+
+        entry, domain, settings, err := getDomainAndEntry( fqdn, &cfg)
         if err != nil {
 		klog.ErrorS( err, "Present() finished with error while determining domain and entry name")
                 return fmt.Errorf("unable to get domain key for zone %s: %v", ch.ResolvedZone, err)
         }
-	klog.V(4).InfoS( "present", "entry", entry, "domain", domain, "entry", entry, "API key", apiKey)
-
-        variomediaClient := NewvariomediaClient(apiKey)
+	span.SetAttributes( attrDomain.String( domain), attrEntry.String( entry))
 
-        url, err := variomediaClient.UpdateTxtRecord(&domain, &entry, &ch.Key, variomediaMinTtl)
-        if err != nil {
-		klog.ErrorS( err, "Present() finished with error while trying to update the DNS record")
-                return fmt.Errorf("unable to change TXT record: %v", err)
-        }
+	// only the secret of the challenged domain is needed
+	apiKey, err := c.loadApiKey( ctx, domain, settings.SecretRef, ch.ResourceNamespace)
+	if err != nil {
+		klog.ErrorS( err, "Present() finished with error while loading API key")
+		return err
+	}
+	c.readiness.apiKeyUsed( domain, apiKey, settings.variomediaSettings)
+	c.sweeper.domainUsed( domain, settings, ch.ResourceNamespace)
+	klog.V(4).InfoS( "present", "entry", entry, "domain", domain, "secret reference", settings.SecretRef)
+
+	// Present() is called again if waiting for propagation failed - the record exists by then
+	if url := c.entries.get( domain, entry, ch.Key); url != "" {
+		klog.V(4).InfoS( "TXT record already created", "entry", entry, "domain", domain, "url", url)
+	} else {
+		variomediaClient := c.newVariomediaClient(apiKey, settings.variomediaSettings, WithEventHandler( c.events.handler( ch)))
+
+		event := newAuditEvent( auditCreate, ch, domain, entry)
+		url, err := variomediaClient.UpdateTxtRecord(ctx, &domain, &entry, &ch.Key, settings.ttl())
+		event.RecordUrl, event.JobId = url, variomediaClient.lastJobId
+		c.audit.record( event, err)
+		if err != nil {
+			klog.ErrorS( err, "Present() finished with error while trying to update the DNS record")
+			return fmt.Errorf("unable to change TXT record: %w", explainVariomediaError(err, domain))
+		}
 
-	// update our cache map... making sure each level of map exists
-	if _, ok := DnsEntryURL[ domain]; !ok {
-		DnsEntryURL[ domain] = make( map[string]map[string]string)
+		// update our cache
+		c.entries.set( domain, entry, ch.Key, url)
+		klog.V(5).InfoS( "updated DNS entry cache", "domain", domain, "entry", entry, "url", url)
+		c.events.record( ch, corev1.EventTypeNormal, reasonRecordCreated, "Created TXT record %s in Variomedia domain %s", entry, domain)
 	}
-	if _, ok := DnsEntryURL[ domain][ entry]; !ok {
-		DnsEntryURL[ domain][ entry] = make( map[string]string)
+
+	// Variomedia reports the job done before all of its name servers serve the record
+	if settings.waitForPropagation() {
+		if err := c.waitForPropagation( ctx, domain, fqdn, ch.Key, settings.variomediaSettings); err != nil {
+			klog.ErrorS( err, "Present() finished with error while waiting for the DNS record to propagate")
+			return fmt.Errorf("TXT record created, but not yet served: %v", err)
+		}
+		c.events.record( ch, corev1.EventTypeNormal, reasonPropagationConfirmed, "TXT record %s is served by all authoritative name servers", fqdn)
 	}
-	DnsEntryURL[ domain][ entry][ ch.Key] = url
-	klog.V(5).InfoS( "updated DNS entry cache", "cache", DnsEntryURL)
 
 	klog.V(4).InfoS( "Present() finished")
 	return nil
 }
 
+// waitForPropagation waits until all name servers authoritative for the domain serve the
+// TXT record, within the configured propagation timeout - or less, as far as the
+// challenge's own deadline requires, so the timeout is reported before cert-manager gives up
+func (c *customDNSProviderSolver) waitForPropagation(ctx context.Context, domain, fqdn, value string, settings variomediaSettings) error {
+	if c.resolver == nil {
+		return fmt.Errorf("unable to check authoritative name servers: no DNS resolver")
+	}
+	timeout := settings.propagationTimeout()
+	if deadline, ok := ctx.Deadline(); ok {
+		if remaining := time.Until( deadline) - propagationDeadlineMargin; remaining < timeout {
+			klog.V(2).InfoS( "shortening wait for authoritative name servers to the challenge's deadline", "fqdn", fqdn, "timeout", remaining)
+			timeout = remaining
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	return c.resolver.waitForTxt(ctx, domain, fqdn, value, settings.propagationPollInterval())
+}
+
 // CleanUp should delete the relevant TXT record from the DNS provider console.
 // If multiple TXT records exist with the same record name (e.g.
 // _acme-challenge.example.com) then **only** the record with the same `key`
 // value provided on the ChallengeRequest should be cleaned up.
 // This is in order to facilitate multiple DNS validations for the same domain
 // concurrently.
-func (c *customDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) error {
+func (c *customDNSProviderSolver) CleanUp(ch *v1alpha1.ChallengeRequest) (err error) {
 	klog.V(4).InfoS( "CleanUp() called")
 	klog.V(5).InfoS("parameters", "challenge", ch)
 
-	cfg, err := c.loadApiKeys(ch.Config, ch.ResourceNamespace)
+	// the domain is known once the configuration was evaluated
+	domain := ""
+	defer func( start time.Time) {
+		observeChallenge( operationCleanUp, domain, start, err)
+	}( time.Now())
+
+	ctx, cancel := c.challengeContext()
+	defer cancel()
+	ctx, span := startSpan( ctx, "CleanUp", attrFqdn.String( ch.ResolvedFQDN), attrZone.String( ch.ResolvedZone))
+	defer func() {
+		endSpan( span, err)
+	}()
+
+	defer func() {
+		if err != nil {
+			c.events.record( ch, corev1.EventTypeWarning, reasonCleanUpFailed, "Cleaning up failed: %v", err)
+		}
+	}()
+
+	cfg, err := loadConfig( ch.Config)
 	if err != nil {
-		klog.ErrorS( err, "CleanUp() finished with error while loading API keys")
+		klog.ErrorS( err, "CleanUp() finished with error while loading configuration")
 		return err
 	}
         klog.V(6).Infof("decoded configuration %v", cfg)
 
-        entry, domain, apiKey, err := c.getDomainAndEntryAndApiKey( ch, &cfg)
+	// in DNS alias mode, the record is created where the challenged name points to
+	fqdn, err := c.challengeFqdn( ctx, ch, &cfg)
+	if err != nil {
+		klog.ErrorS( err, "CleanUp() finished with error while resolving the challenged name")
+		return fmt.Errorf("unable to determine TXT record for %s: %v", ch.ResolvedFQDN, err)
+	}
+
+        entry, domain, settings, err := getDomainAndEntry( fqdn, &cfg)
         if err != nil {
 		klog.ErrorS( err, "CleanUp() finished with error while determining domain and entry name")
                 return fmt.Errorf("unable to get domain key for zone %s: %v", ch.ResolvedZone, err)
         }
-	klog.V(4).InfoS( "clean up", "entry", entry, "domain", domain, "entry", entry, "API key", apiKey)
+	span.SetAttributes( attrDomain.String( domain), attrEntry.String( entry))
+
+	// only the secret of the challenged domain is needed
+	apiKey, err := c.loadApiKey( ctx, domain, settings.SecretRef, ch.ResourceNamespace)
+	if err != nil {
+		klog.ErrorS( err, "CleanUp() finished with error while loading API key")
+		return err
+	}
+	c.readiness.apiKeyUsed( domain, apiKey, settings.variomediaSettings)
+	c.sweeper.domainUsed( domain, settings, ch.ResourceNamespace)
+	klog.V(4).InfoS( "clean up", "entry", entry, "domain", domain, "secret reference", settings.SecretRef)
+
+        variomediaClient := c.newVariomediaClient(apiKey, settings.variomediaSettings, WithEventHandler( c.events.handler( ch)))
 
-        variomediaClient := NewvariomediaClient(apiKey)
+	url := c.entries.get( domain, entry, ch.Key)
 
-	url := DnsEntryURL[ domain][ entry][ ch.Key]
+	if url == "" && !settings.lookupOnCleanUp() {
+		klog.V(4).InfoS( "CleanUp() finished, DNS entry not cached and lookup is disabled", "entry", entry, "domain", domain)
+		return nil
+	}
 
-        err = variomediaClient.DeleteTxtRecord( url, variomediaMinTtl)
+	// the cache is only an optimization - after a restart or when another replica
+	// presented the challenge, we have to ask Variomedia for the record
+	if url == "" {
+		klog.V(4).InfoS( "DNS entry not cached, looking it up at Variomedia", "entry", entry, "domain", domain)
+		url, err = variomediaClient.FindTxtRecord( ctx, &domain, &entry, &ch.Key)
+		if err != nil {
+			klog.ErrorS( err, "CleanUp() finished with error while looking up the DNS record")
+			return fmt.Errorf("unable to look up TXT record: %w", explainVariomediaError(err, domain))
+		}
+		if url == "" {
+			klog.V(4).InfoS( "CleanUp() finished, no matching TXT record found at Variomedia")
+			return nil
+		}
+	}
+
+	event := newAuditEvent( auditDelete, ch, domain, entry)
+        err = variomediaClient.DeleteTxtRecord( ctx, url)
+	event.RecordUrl, event.JobId = url, variomediaClient.lastJobId
+	c.audit.record( event, err)
         if err != nil {
 		klog.ErrorS( err, "CleanUp() finished with error while trying to delete the DNS record")
-                return fmt.Errorf("unable to delete TXT record: %v", err)
+                return fmt.Errorf("unable to delete TXT record: %w", explainVariomediaError(err, domain))
         }
 
 	// DNS entry deleted - so we delete our cache entry
-	delete( DnsEntryURL[ domain][ entry], ch.Key)
-	klog.V(5).InfoS( "updated DNS entry cache", "cache", DnsEntryURL)
+	c.entries.delete( domain, entry, ch.Key)
+	klog.V(5).InfoS( "updated DNS entry cache", "domain", domain, "entry", entry)
+	c.events.record( ch, corev1.EventTypeNormal, reasonCleanedUp, "Deleted TXT record %s in Variomedia domain %s", entry, domain)
 
 	klog.V(4).InfoS( "CleanUp() finished")
 	return nil
 }
 
+// newVariomediaClient creates an API client for the given key, using the solver's
+// API endpoint and HTTP client settings and the domain's polling settings, plus any
+// further options
+func (c *customDNSProviderSolver) newVariomediaClient(apiKey variomediaApiKey, settings variomediaSettings, extraOpts ...variomediaClientOption) *variomediaClient {
+	opts := []variomediaClientOption{ WithBaseUrl(c.apiBaseUrl), WithHttpClient(c.httpClient)}
+	jobWaiter := c.jobWaiter
+	if jobWaiter == (variomediaJobWaiter{}) {
+		jobWaiter = defaultJobWaiter()
+	}
+	opts = append(opts, WithJobWaiter(settings.jobWaiter(jobWaiter)))
+	if c.rateLimiters != nil {
+		opts = append(opts, WithRateLimiter(c.rateLimiters.get(apiKey)))
+	}
+	return NewvariomediaClient(apiKey, append(opts, extraOpts...)...)
+}
+
+// apiSettingsFromEnv determines the Variomedia API endpoint and the HTTP client to use
+// from the webhook's environment
+func apiSettingsFromEnv() (string, *http.Client, error) {
+	klog.V(4).InfoS( "apiSettingsFromEnv() called")
+
+	baseUrl := os.Getenv(envApiUrl)
+	if baseUrl != "" {
+		if _, err := url.ParseRequestURI(baseUrl); err != nil {
+			return "", nil, fmt.Errorf("invalid %s `%s`: %v", envApiUrl, baseUrl, err)
+		}
+	}
+
+	timeout, err := durationFromEnv(envApiTimeout, variomediaDefaultTimeout)
+	if err != nil {
+		return "", nil, err
+	}
+
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	if value := os.Getenv(envApiProxy); value != "" {
+		proxyUrl, err := url.Parse(value)
+		if err != nil {
+			return "", nil, fmt.Errorf("invalid %s `%s`: %v", envApiProxy, value, err)
+		}
+		transport.Proxy = http.ProxyURL(proxyUrl)
+	}
+
+	klog.V(4).InfoS( "apiSettingsFromEnv() finished")
+	klog.V(5).InfoS("return values", "base URL", baseUrl, "timeout", timeout, "proxy", os.Getenv(envApiProxy))
+	return baseUrl, &http.Client{ Transport: transport, Timeout: timeout}, nil
+}
+
+// jobWaiterFromEnv determines how to wait for Variomedia's DNS jobs from the webhook's
+// environment
+func jobWaiterFromEnv() (variomediaJobWaiter, error) {
+	var err error
+	w := defaultJobWaiter()
+	if w.InitialDelay, err = durationFromEnv(envJobPollInterval, w.InitialDelay); err != nil {
+		return w, err
+	}
+	if w.MaxDelay, err = durationFromEnv(envJobPollMaxInterval, w.MaxDelay); err != nil {
+		return w, err
+	}
+	if w.Deadline, err = durationFromEnv(envJobTimeout, w.Deadline); err != nil {
+		return w, err
+	}
+	if w.MaxDelay < w.InitialDelay {
+		return w, fmt.Errorf("%s must not be less than %s", envJobPollMaxInterval, envJobPollInterval)
+	}
+	return w, nil
+}
+
+// rateLimitersFromEnv determines the client-side request limit per API key from the
+// webhook's environment
+func rateLimitersFromEnv() (*apiKeyRateLimiters, error) {
+	limit := float64(defaultApiRateLimit)
+	if value := os.Getenv(envApiRateLimit); value != "" {
+		var err error
+		limit, err = strconv.ParseFloat(value, 64)
+		if err != nil || limit <= 0 {
+			return nil, fmt.Errorf("invalid %s `%s`: must be a positive number", envApiRateLimit, value)
+		}
+	}
+	burst := defaultApiRateBurst
+	if value := os.Getenv(envApiRateBurst); value != "" {
+		var err error
+		burst, err = strconv.Atoi(value)
+		if err != nil || burst <= 0 {
+			return nil, fmt.Errorf("invalid %s `%s`: must be a positive integer", envApiRateBurst, value)
+		}
+	}
+	return newApiKeyRateLimiters(rate.Limit(limit), burst), nil
+}
+
+// namespaceAllowList holds the namespaces secrets may be referenced from
+type namespaceAllowList struct {
+	all bool
+	namespaces map[string]bool
+}
+
+// allows reports whether secrets may be read from the given namespace
+func (l namespaceAllowList) allows(namespace string) bool {
+	return l.all || l.namespaces[namespace]
+}
+
+// namespaceAllowListFromEnv determines the namespaces (besides the challenge's own) secrets
+// may be read from. By default, no other namespaces are permitted.
+func namespaceAllowListFromEnv() namespaceAllowList {
+	l := namespaceAllowList{ namespaces: map[string]bool{}}
+	for _, namespace := range strings.Split(os.Getenv(envSecretNamespaces), ",") {
+		namespace = strings.TrimSpace(namespace)
+		switch namespace {
+		case "":
+		case "*":
+			l.all = true
+		default:
+			l.namespaces[namespace] = true
+		}
+	}
+	return l
+}
+
+// durationFromEnv reads a positive duration from the given environment variable,
+// returning the default value if it is not set
+func durationFromEnv(name string, defaultValue time.Duration) (time.Duration, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	duration, err := time.ParseDuration(value)
+	if err != nil || duration <= 0 {
+		return 0, fmt.Errorf("invalid %s `%s`: must be a positive duration", name, value)
+	}
+	return duration, nil
+}
+
+// positiveIntFromEnv reads a positive integer from the given environment variable,
+// returning the default value if it is not set
+func positiveIntFromEnv(name string, defaultValue int) (int, error) {
+	value := os.Getenv(name)
+	if value == "" {
+		return defaultValue, nil
+	}
+	number, err := strconv.Atoi(value)
+	if err != nil || number <= 0 {
+		return 0, fmt.Errorf("invalid %s `%s`: must be a positive integer", name, value)
+	}
+	return number, nil
+}
+
+// challengeContext derives the context for a single Present() or CleanUp() call: it is
+// cancelled when the webhook is stopped or when the challenge timeout is reached
+func (c *customDNSProviderSolver) challengeContext() (context.Context, context.CancelFunc) {
+	ctx := c.ctx
+	if ctx == nil {
+		ctx = context.Background()
+	}
+	timeout := c.challengeTimeout
+	if timeout <= 0 {
+		timeout = defaultChallengeTimeout
+	}
+	return context.WithTimeout(ctx, timeout)
+}
+
+// explainVariomediaError adds a hint on what to check to errors reported by Variomedia,
+// as the error ends up in the Challenge's status
+func explainVariomediaError(err error, domain string) error {
+	switch {
+	case isVariomediaApiError(err, (*variomediaApiError).IsAuth):
+		return fmt.Errorf("API key configured for domain '%s' was rejected: %w", domain, err)
+	case isVariomediaApiError(err, (*variomediaApiError).IsNotFound):
+		return fmt.Errorf("domain '%s' or its record not found at Variomedia: %w", domain, err)
+	case isVariomediaApiError(err, (*variomediaApiError).IsTransient):
+		return fmt.Errorf("temporary failure, will be retried: %w", err)
+	}
+	return err
+}
+
 // loadConfig is a small helper function that decodes JSON configuration into
 // the typed config struct.
 func loadConfig(cfgJSON *extapi.JSON) (customDNSProviderConfig, error) {
@@ -211,7 +684,8 @@ func loadConfig(cfgJSON *extapi.JSON) (customDNSProviderConfig, error) {
 	if cfgJSON == nil {
 		return cfg, nil
 	}
-	if err := json.Unmarshal(cfgJSON.Raw, &cfg); err != nil {
+	cfg, err := decodeConfig(cfgJSON.Raw)
+	if err != nil {
 		return cfg, fmt.Errorf("error decoding solver config: %v", err)
 	}
 
@@ -220,61 +694,141 @@ func loadConfig(cfgJSON *extapi.JSON) (customDNSProviderConfig, error) {
 	return cfg, nil
 }
 
-// loadApiKeys is a small helper function that takes the decoded JSON configuration
-// and extracts the according keys.
-// It's called as a wrapper to loadConfig()
-func (c *customDNSProviderSolver) loadApiKeys(cfgJSON *extapi.JSON, namespace string) ( customDNSProviderConfig, error) {
-	klog.V(4).InfoS( "loadApiKeys() called")
-	klog.V(5).InfoS("parameters", "config", cfgJSON, "namespace", namespace)
-
-	// retrieve configuration block from Kubernetes Issuer config
-	cfg, err := loadConfig( cfgJSON)
+// loadApiKey is a small helper function that reads the API key of a domain from the
+// secret referenced in its configuration.
+// Secrets are read from the challenge's namespace, unless the admin permitted others.
+func (c *customDNSProviderSolver) loadApiKey(ctx context.Context, domain string, ref variomediaSecretRef, namespace string) ( _ variomediaApiKey, err error) {
+	klog.V(4).InfoS( "loadApiKey() called")
+	klog.V(5).InfoS("parameters", "domain", domain, "secret reference", ref, "namespace", namespace)
+
+	ctx, span := startSpan( ctx, "loadApiKey", attrDomain.String( domain))
+	defer func() {
+		endSpan( span, err)
+	}()
+
+	secretNamespace := namespace
+	if ref.Namespace != "" && ref.Namespace != namespace {
+		secretNamespace = ref.Namespace
+		if !c.secretNamespaces.allows(secretNamespace) {
+			err := fmt.Errorf("secret `%s` for domain '%s' must be in namespace '%s': namespace '%s' is not permitted by %s",
+				ref.Name, domain, namespace, secretNamespace, envSecretNamespaces)
+			klog.ErrorS( err, "loadApiKey() finished with error")
+			return variomediaApiKey{}, err
+		}
+	}
 
-	// no config? Abort.
+	klog.V(6).Infof("try to load secret `%s/%s` with key `%s`", secretNamespace, ref.Name, ref.Key)
+	span.SetAttributes( attrSecret.String( secretNamespace + "/" + ref.Name))
+	sec, err := c.getSecret(ctx, secretNamespace, ref.Name, ref.Key)
 	if err != nil {
-		return cfg, err
+		klog.ErrorS( err, "loadApiKey() finished with error")
+		return variomediaApiKey{}, fmt.Errorf("unable to get secret `%s/%s`; %v", secretNamespace, ref.Name, err)
 	}
 
-	for domain, secretName := range cfg {
-		klog.V(6).Infof("try to load secret `%s` with key `%s`", secretName, "api-token")
-		sec, err := c.client.CoreV1().Secrets(namespace).Get(context.Background(), secretName, metav1.GetOptions{})
-		if err != nil {
-			klog.ErrorS( err, "loadApiKeys() finished with error")
-			return nil, fmt.Errorf("unable to get secret `%s`; %v", secretName, err)
-		}
+	secBytes, ok := sec.Data[ref.Key]
+	if !ok {
+		err := fmt.Errorf("key %q not found in secret \"%s/%s\"", ref.Key, secretNamespace, ref.Name)
+		klog.ErrorS( err, "loadApiKey() finished with error")
+		return variomediaApiKey{}, err
+	}
+	apiKey := newVariomediaApiKey( trimApiKey( string(secBytes)))
 
-		secBytes, ok := sec.Data["api-token"]
-		if !ok {
-			klog.ErrorS( err, "loadApiKeys() finished with error")
-			return nil, fmt.Errorf("key %q not found in secret \"%s/%s\"", "api-token",
-				secretName, namespace)
-		}
-		// replace name of secret with value of apiKey - and trim blanks and newlines
-		cfg[domain] = strings.TrimRight( string(secBytes), "\r\n ")
-		klog.V(6).InfoS( "stored API key", "domain", domain, "API key", cfg[domain])
+	klog.V(4).InfoS( "loadApiKey() finished")
+	klog.V(6).InfoS( "return values", "domain", domain, "API key", apiKey)
+        return apiKey, nil
+}
+
+// getSecret reads a secret to take the data key from, from the secret cache or, without
+// one, from the API server
+func (c *customDNSProviderSolver) getSecret(ctx context.Context, namespace, name, key string) (*corev1.Secret, error) {
+	if c.secrets != nil {
+		return c.secrets.get(ctx, namespace, name, key)
 	}
+	return c.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+}
 
-	klog.V(4).InfoS( "loadApiKeys() finished")
-        return cfg, nil
+// apiKeyRotated drops all state kept for an API key that was replaced or removed
+func (c *customDNSProviderSolver) apiKeyRotated(secret types.NamespacedName, key string, oldValue string) {
+	klog.V(4).InfoS( "dropping state of previous API key", "secret", secret, "key", key)
+	if c.rateLimiters != nil {
+		c.rateLimiters.forget( newVariomediaApiKey( trimApiKey( oldValue)))
+	}
+	c.readiness.forgetApiKey( newVariomediaApiKey( trimApiKey( oldValue)))
 }
 
-// determine the appropriate domain, according API key and the actual entry to make
-func (c *customDNSProviderSolver) getDomainAndEntryAndApiKey(ch *v1alpha1.ChallengeRequest, cfg *customDNSProviderConfig) (string, string, string, error) {
-	klog.V(4).InfoS( "getDomainAndEntryAndApiKey() called")
-	klog.V(5).InfoS("parameters", "challenge", ch, "provider config", cfg)
+// trimApiKey removes trailing blanks and newlines, i.e. from secrets created with "echo"
+func trimApiKey(value string) string {
+	return strings.TrimRight( value, "\r\n ")
+}
+
+// determine the appropriate domain, its configuration and the actual entry to make.
+// The domain is the most specific configured domain the FQDN belongs to, as
+// cert-manager's idea of the zone (ch.ResolvedZone) may differ from how the domain is
+// set up at Variomedia, i.e. with split-horizon DNS or sub-zones.
+func getDomainAndEntry(fqdn string, cfg *customDNSProviderConfig) (string, string, variomediaDomainConfig, error) {
+	klog.V(4).InfoS( "getDomainAndEntry() called")
+	klog.V(5).InfoS("parameters", "fqdn", fqdn, "provider config", cfg)
 
-        // Both ch.ResolvedZone and ch.ResolvedFQDN end with a dot: '.'
-        entry := strings.TrimSuffix(ch.ResolvedFQDN, ch.ResolvedZone)
-        entry = strings.TrimSuffix(entry, ".")
-        domain := strings.TrimSuffix(ch.ResolvedZone, ".")
-        apiKey, ok := (*cfg)[domain]
+        fqdn = normalizeDomainName(fqdn)
+        domain, settings, ok := cfg.match(fqdn)
         if !ok {
-		klog.ErrorS( fmt.Errorf("domain '%s' not found in config.", domain), "getDomainAndEntryAndApiKey() finished with error")
-                return entry, domain, apiKey, fmt.Errorf("domain '%s' not found in config.", domain)
+		err := fmt.Errorf("neither '%s' nor any of its parent domains found in config.", fqdn)
+		klog.ErrorS( err, "getDomainAndEntry() finished with error")
+		return "", "", settings, err
+	}
+
+	// the entry is relative to the domain - empty for the domain's apex
+	entry := strings.TrimSuffix(strings.TrimSuffix(fqdn, domain), ".")
+
+	klog.V(4).InfoS( "getDomainAndEntry() finished")
+	klog.V(5).InfoS("return values", "entry", entry, "domain", domain, "settings", settings)
+        return entry, domain, settings, nil
+}
+
+// challengeFqdn determines the name of the TXT record for the challenge: the challenged
+// name itself or, if the challenge is delegated to a Variomedia domain via CNAME, the
+// name it is delegated to. Delegated names must be within a configured domain.
+func (c *customDNSProviderSolver) challengeFqdn(ctx context.Context, ch *v1alpha1.ChallengeRequest, cfg *customDNSProviderConfig) (string, error) {
+	klog.V(4).InfoS( "challengeFqdn() called")
+
+	fqdn := normalizeDomainName(ch.ResolvedFQDN)
+	if _, _, ok := cfg.match(fqdn); ok {
+		klog.V(4).InfoS( "challengeFqdn() finished")
+		return fqdn, nil
+	}
+
+	target, ok := cfg.aliasTarget(fqdn)
+	switch {
+	case ok:
+		klog.V(4).InfoS( "challenge delegated via configured alias", "fqdn", fqdn, "target", target)
+	case cfg.FollowCNAME:
+		if c.resolver == nil {
+			return "", fmt.Errorf("unable to follow CNAME of '%s': no DNS resolver", fqdn)
+		}
+		var err error
+		target, err = c.resolver.followCNAME(ctx, fqdn)
+		if err != nil {
+			klog.ErrorS( err, "challengeFqdn() finished with error")
+			return "", err
+		}
+		target = normalizeDomainName(target)
+		klog.V(4).InfoS( "challenge delegated via CNAME", "fqdn", fqdn, "target", target)
+	default:
+		// not delegated - getDomainAndEntry() reports the missing domain
+		klog.V(4).InfoS( "challengeFqdn() finished")
+		return fqdn, nil
+	}
+
+	// never write outside the configured domains
+	if err := validateDnsName(target); err != nil {
+		return "", fmt.Errorf("'%s' is delegated to an invalid name: %v", fqdn, err)
+	}
+	if _, _, ok := cfg.match(target); !ok {
+		return "", fmt.Errorf("'%s' is delegated to '%s', which is not within any of the configured domains", fqdn, target)
 	}
 
-	klog.V(4).InfoS( "getDomainAndEntryAndApiKey() finished")
-	klog.V(5).InfoS("return values", "entry", entry, "domain", domain, "API key", apiKey)
-        return entry, domain, apiKey, nil
+	klog.V(4).InfoS( "challengeFqdn() finished")
+	klog.V(5).InfoS("return values", "fqdn", target)
+	return target, nil
 }
 
@@ -1,10 +1,27 @@
 package main
 
 import (
+	"context"
+	"fmt"
+	"net"
+	"net/http"
 	"os"
+	"sync"
 	"testing"
+	"time"
 
+	"github.com/jetstack/cert-manager/pkg/acme/webhook/apis/acme/v1alpha1"
 	"github.com/jetstack/cert-manager/test/acme/dns"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	extapi "k8s.io/apiextensions-apiserver/pkg/apis/apiextensions/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/fake"
+	"k8s.io/client-go/rest"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
 )
 
 var (
@@ -12,6 +29,10 @@ var (
 )
 
 func TestRunsSuite(t *testing.T) {
+	if zone == "" {
+		t.Skip("TEST_ZONE_NAME not set, skipping the test against the live Variomedia API")
+	}
+
 	// The manifest path should contain a file named config.json that is a
 	// snippet of valid configuration that should be included on the
 	// ChallengeRequest passed as part of the test cases.
@@ -28,3 +49,312 @@ func TestRunsSuite(t *testing.T) {
 	fixture.RunExtended(t)
 
 }
+
+// TestRunsSuiteOffline runs the conformance tests against the fake Variomedia API, with
+// the resulting records served by a local DNS server instead of Variomedia's name servers
+func TestRunsSuiteOffline(t *testing.T) {
+	// the token matches the secret in testdata/offline
+	fake := fakevariomedia.NewTest(t, "fake-api-token")
+	apiUrl := fake.URL()
+	dnsAddr, err := fake.StartDNS()
+	if err != nil {
+		t.Fatalf("unable to start local DNS server: %v", err)
+	}
+
+	solver := &customDNSProviderSolver{
+		apiBaseUrl: apiUrl,
+		httpClient: http.DefaultClient,
+	}
+	fixture := dns.NewFixture(solver,
+		dns.SetResolvedZone("example.com."),
+		dns.SetAllowAmbientCredentials(false),
+		dns.SetManifestPath("testdata/offline"),
+		dns.SetDNSServer(dnsAddr),
+		dns.SetUseAuthoritative(false),
+	)
+	fixture.RunBasic(t)
+	fixture.RunExtended(t)
+}
+
+// newTestSolver creates a solver talking to the fake Variomedia API, with the API key
+// provided in secret "variomedia-credentials" in namespace "default"
+func newTestSolver(fakeApi *fakevariomedia.Server, apiKey string) *customDNSProviderSolver {
+	return &customDNSProviderSolver{
+		client: fake.NewSimpleClientset(&corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "variomedia-credentials", Namespace: "default"},
+			Data:       map[string][]byte{"api-token": []byte(apiKey + "\n")},
+		}),
+		apiBaseUrl: fakeApi.URL(),
+		httpClient: http.DefaultClient,
+	}
+}
+
+// newTestChallenge creates a challenge request for the solver created by newTestSolver()
+func newTestChallenge(zone, fqdn, key string) *v1alpha1.ChallengeRequest {
+	return &v1alpha1.ChallengeRequest{
+		Type:              "dns-01",
+		Key:               key,
+		ResourceNamespace: "default",
+		ResolvedZone:      zone,
+		ResolvedFQDN:      fqdn,
+		Config:            &extapi.JSON{Raw: []byte(`{"example.com": "variomedia-credentials", "example.org": "variomedia-credentials"}`)},
+	}
+}
+
+// TestPresentCleanUpConcurrently is meant to be run with the race detector enabled
+func TestPresentCleanUpConcurrently(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "fake-api-token")
+
+	var challenges []*v1alpha1.ChallengeRequest
+	for i := 0; i < 20; i++ {
+		challenges = append(challenges,
+			newTestChallenge("example.com.", "_acme-challenge.example.com.", fmt.Sprintf("key-%d", i)),
+			newTestChallenge("example.org.", fmt.Sprintf("_acme-challenge.host%d.example.org.", i%3), fmt.Sprintf("key-%d", i)),
+		)
+	}
+
+	var wg sync.WaitGroup
+	for _, ch := range challenges {
+		wg.Add(1)
+		go func(ch *v1alpha1.ChallengeRequest) {
+			defer wg.Done()
+			assert.NoError(t, solver.Present(ch))
+			assert.NoError(t, solver.CleanUp(ch))
+		}(ch)
+	}
+	wg.Wait()
+
+	assert.Empty(t, fakeApi.Records())
+	assert.Equal(t, 0, solver.entries.len())
+}
+
+func TestCleanUp_WithoutCachedUrl(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	require.NoError(t, newTestSolver(fakeApi, "fake-api-token").Present(ch))
+	// records differing in name, type or value are not touched
+	for _, record := range []fakevariomedia.Record{
+		{RecordType: "TXT", Name: "_acme-challenge.www", Domain: "example.com", Data: "challenge-key", Ttl: 300},
+		{RecordType: "CNAME", Name: "_acme-challenge", Domain: "example.com", Data: "challenge-key", Ttl: 300},
+		{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "challenge-key-2", Ttl: 300},
+	} {
+		fakeApi.AddRecord(record)
+	}
+
+	// a restarted webhook knows no record URLs, so it looks the record up
+	restarted := newTestSolver(fakeApi, "fake-api-token")
+	require.NoError(t, restarted.CleanUp(ch))
+	assert.ElementsMatch(t, []string{"challenge-key", "challenge-key", "challenge-key-2"}, recordValues(fakeApi))
+	for _, record := range fakeApi.Records() {
+		assert.False(t, record.RecordType == "TXT" && record.Name == "_acme-challenge" && record.Data == "challenge-key")
+	}
+
+	// cleaning up a record that is gone already succeeds
+	require.NoError(t, restarted.CleanUp(ch))
+	assert.Len(t, fakeApi.Records(), 3)
+}
+
+func TestInitializeStopCancelsRequests(t *testing.T) {
+	solver := &customDNSProviderSolver{httpClient: http.DefaultClient}
+	stopCh := make(chan struct{})
+	assert.NoError(t, solver.Initialize(&rest.Config{Host: "http://127.0.0.1:1"}, stopCh))
+
+	ctx, cancel := solver.challengeContext()
+	defer cancel()
+	close(stopCh)
+	select {
+	case <-ctx.Done():
+	case <-time.After(time.Second):
+		t.Fatal("challenge context not cancelled after stopping the webhook")
+	}
+}
+
+func TestPresent_SecretReference(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "wrong-api-token")
+	shared := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "shared-credentials", Namespace: "cert-manager"},
+		Data:       map[string][]byte{"token": []byte("fake-api-token")},
+	}
+	_, err := solver.client.CoreV1().Secrets("cert-manager").Create(context.Background(), shared, metav1.CreateOptions{})
+	require.NoError(t, err)
+
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "key")
+	ch.Config = &extapi.JSON{Raw: []byte(`{"version": 1, "domains": {"example.com": {"secretRef": {"name": "shared-credentials", "key": "token", "namespace": "cert-manager"}}}}`)}
+
+	// other namespaces have to be permitted explicitly
+	err = solver.Present(ch)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "namespace 'cert-manager' is not permitted")
+	assert.Empty(t, fakeApi.Records())
+
+	t.Setenv(envSecretNamespaces, "kube-system, cert-manager")
+	solver.secretNamespaces = namespaceAllowListFromEnv()
+	require.NoError(t, solver.Present(ch))
+	assert.Len(t, fakeApi.Records(), 1)
+	require.NoError(t, solver.CleanUp(ch))
+	assert.Empty(t, fakeApi.Records())
+}
+
+func TestNamespaceAllowListFromEnv(t *testing.T) {
+	t.Setenv(envSecretNamespaces, "")
+	l := namespaceAllowListFromEnv()
+	assert.False(t, l.allows("cert-manager"))
+
+	t.Setenv(envSecretNamespaces, " cert-manager ,other")
+	l = namespaceAllowListFromEnv()
+	assert.True(t, l.allows("cert-manager"))
+	assert.True(t, l.allows("other"))
+	assert.False(t, l.allows("kube-system"))
+
+	t.Setenv(envSecretNamespaces, "*")
+	assert.True(t, namespaceAllowListFromEnv().allows("kube-system"))
+}
+
+func TestPresent_LoadsOnlyNeededSecret(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	clientset := solver.client.(*fake.Clientset)
+
+	// the secret of example.org does not exist, which must not affect example.com
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "key")
+	ch.Config = &extapi.JSON{Raw: []byte(`{"example.com": "variomedia-credentials", "example.org": "missing-credentials", "example.net": "missing-credentials"}`)}
+	require.NoError(t, solver.Present(ch))
+	require.NoError(t, solver.CleanUp(ch))
+	assert.Empty(t, fakeApi.Records())
+
+	var secretNames []string
+	for _, action := range clientset.Actions() {
+		if get, ok := action.(k8stesting.GetAction); ok && action.GetResource().Resource == "secrets" {
+			secretNames = append(secretNames, get.GetName())
+		}
+	}
+	assert.Equal(t, []string{"variomedia-credentials", "variomedia-credentials"}, secretNames)
+
+	ch = newTestChallenge("example.org.", "_acme-challenge.example.org.", "key")
+	ch.Config = &extapi.JSON{Raw: []byte(`{"example.com": "variomedia-credentials", "example.org": "missing-credentials"}`)}
+	err := solver.Present(ch)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "missing-credentials")
+}
+
+func TestGetDomainAndEntry(t *testing.T) {
+	cfg, err := decodeConfig([]byte(`{"example.com": "credentials-01", "sub.example.com": "credentials-02", "example.org.": "credentials-03"}`))
+	require.NoError(t, err)
+
+	tests := []struct {
+		name   string
+		fqdn   string
+		domain string
+		entry  string
+		secret string
+	}{
+		{name: "exact zone", fqdn: "_acme-challenge.example.com.", domain: "example.com", entry: "_acme-challenge", secret: "credentials-01"},
+		{name: "multi-level entry", fqdn: "_acme-challenge.a.b.example.com.", domain: "example.com", entry: "_acme-challenge.a.b", secret: "credentials-01"},
+		{name: "most specific domain", fqdn: "_acme-challenge.www.sub.example.com.", domain: "sub.example.com", entry: "_acme-challenge.www", secret: "credentials-02"},
+		{name: "cert-manager zone differing from domain", fqdn: "_acme-challenge.host.internal.example.org.", domain: "example.org", entry: "_acme-challenge.host.internal", secret: "credentials-03"},
+		{name: "apex", fqdn: "example.com.", domain: "example.com", entry: "", secret: "credentials-01"},
+		{name: "without trailing dot", fqdn: "_acme-challenge.Example.COM", domain: "example.com", entry: "_acme-challenge", secret: "credentials-01"},
+		{name: "label suffix only", fqdn: "_acme-challenge.notexample.com.", secret: ""},
+		{name: "unknown domain", fqdn: "_acme-challenge.example.net.", secret: ""},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			entry, domain, settings, err := getDomainAndEntry(tt.fqdn, &cfg)
+			if tt.secret == "" {
+				assert.Error(t, err)
+				return
+			}
+			require.NoError(t, err)
+			assert.Equal(t, tt.domain, domain)
+			assert.Equal(t, tt.entry, entry)
+			assert.Equal(t, tt.secret, settings.SecretRef.Name)
+		})
+	}
+}
+
+func TestPresent_DelegatedChallenge(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	dnsAddr, err := fakeApi.StartDNS()
+	require.NoError(t, err)
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	solver.resolver = newDnsResolver([]string{dnsAddr})
+
+	// example.net is hosted elsewhere, its challenges are delegated to example.com
+	fakeApi.AddRecord(fakevariomedia.Record{RecordType: "CNAME", Name: "_acme-challenge.www", Domain: "example.net", Data: "_acme-challenge.www.example-net.example.com", Ttl: 300})
+	fakeApi.AddRecord(fakevariomedia.Record{RecordType: "CNAME", Name: "_acme-challenge", Domain: "example.org", Data: "_acme-challenge.example.invalid", Ttl: 300})
+
+	for name, config := range map[string]string{
+		"alias":        `{"version": 1, "domains": {"example.com": {"secretRef": {"name": "variomedia-credentials"}}}, "aliases": {"example.net": "example-net.example.com"}}`,
+		"follow CNAME": `{"version": 1, "domains": {"example.com": {"secretRef": {"name": "variomedia-credentials"}}}, "followCNAME": true}`,
+	} {
+		t.Run(name, func(t *testing.T) {
+			ch := newTestChallenge("example.net.", "_acme-challenge.www.example.net.", "key")
+			ch.Config = &extapi.JSON{Raw: []byte(config)}
+			require.NoError(t, solver.Present(ch))
+
+			var txt []fakevariomedia.Record
+			for _, record := range fakeApi.Records() {
+				if record.RecordType == "TXT" {
+					txt = append(txt, record)
+				}
+			}
+			require.Len(t, txt, 1)
+			assert.Equal(t, "_acme-challenge.www.example-net", txt[0].Name)
+			assert.Equal(t, "example.com", txt[0].Domain)
+
+			require.NoError(t, solver.CleanUp(ch))
+			assert.Len(t, fakeApi.Records(), 2, "only the CNAME records should be left")
+		})
+	}
+
+	// CNAMEs pointing outside the configured domains are not followed
+	ch := newTestChallenge("example.org.", "_acme-challenge.example.org.", "key")
+	ch.Config = &extapi.JSON{Raw: []byte(`{"version": 1, "domains": {"example.com": {"secretRef": {"name": "variomedia-credentials"}}}, "followCNAME": true}`)}
+	err = solver.Present(ch)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not within any of the configured domains")
+	assert.Len(t, fakeApi.Records(), 2)
+}
+
+func TestPresent_WaitForPropagation(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	fakeApi.DNSDelay = time.Second
+	dnsAddr, err := fakeApi.StartDNS()
+	require.NoError(t, err)
+	_, dnsPort, err := net.SplitHostPort(dnsAddr)
+	require.NoError(t, err)
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	solver.resolver = newDnsResolver([]string{dnsAddr})
+	solver.resolver.authoritativePort = dnsPort
+
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "key")
+	ch.Config = &extapi.JSON{Raw: []byte(`{"version": 1, "defaults": {"propagationPollInterval": "50ms", "propagationTimeout": "100ms", "options": {"waitForPropagation": true}},
+		"domains": {"example.com": {"secretRef": {"name": "variomedia-credentials"}}}}`)}
+
+	// the name server lags behind for longer than the deadline
+	err = solver.Present(ch)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not served by authoritative name servers")
+
+	// the wait ends in time to report it before the challenge's own deadline
+	ch.Config = &extapi.JSON{Raw: []byte(`{"version": 1, "defaults": {"propagationPollInterval": "50ms", "propagationTimeout": "5s", "options": {"waitForPropagation": true}},
+		"domains": {"example.com": {"secretRef": {"name": "variomedia-credentials"}}}}`)}
+	solver.challengeTimeout = propagationDeadlineMargin + 100*time.Millisecond
+	start := time.Now()
+	err = solver.Present(ch)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "not served by authoritative name servers")
+	assert.Less(t, int64(time.Since(start)), int64(solver.challengeTimeout-propagationDeadlineMargin/2))
+
+	// calling Present() again continues waiting, without creating another record
+	solver.challengeTimeout = 0
+	start = time.Now()
+	require.NoError(t, solver.Present(ch))
+	assert.Less(t, int64(time.Since(start)), int64(5*time.Second))
+	assert.Len(t, fakeApi.Records(), 1)
+
+	require.NoError(t, solver.CleanUp(ch))
+	assert.Empty(t, fakeApi.Records())
+}
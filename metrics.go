@@ -0,0 +1,176 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// Prometheus metrics, served on a dedicated port along with the health endpoints
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// prefix of all metric names
+	metricsNamespace = "variomedia_webhook"
+	// path the metrics are served on
+	metricsPath = "/metrics"
+	// time given to running scrapes when the webhook stops
+	metricsShutdownTimeout = 5 * time.Second
+)
+
+// label values
+const (
+	operationPresent = "present"
+	operationCleanUp = "cleanup"
+
+	outcomeSuccess = "success"
+	outcomeError   = "error"
+
+	// domain label of challenges that failed before their domain was determined
+	unknownDomain = "unknown"
+	// status label of requests that got no response
+	statusNoResponse = "error"
+
+	// who enforced a rate limit: our own token bucket or Variomedia (HTTP status 429)
+	rateLimitClient     = "client"
+	rateLimitVariomedia = "variomedia"
+)
+
+var (
+	challengesTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "challenges_total",
+		Help:      "Number of presented and cleaned up challenges, by domain and outcome.",
+	}, []string{"operation", "domain", "outcome"})
+
+	challengeDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "challenge_duration_seconds",
+		Help:      "Time taken to present or clean up a challenge, by domain and outcome.",
+		Buckets:   []float64{0.1, 0.25, 0.5, 1, 2.5, 5, 10, 20, 30, 45, 60, 90},
+	}, []string{"operation", "domain", "outcome"})
+
+	apiRequestsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_requests_total",
+		Help:      "Number of HTTP requests sent to the Variomedia API, by method and response status.",
+	}, []string{"method", "status"})
+
+	apiRequestDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "api_request_duration_seconds",
+		Help:      "Time taken by HTTP requests to the Variomedia API, by method.",
+		Buckets:   prometheus.DefBuckets,
+	}, []string{"method"})
+
+	jobWaitDuration = prometheus.NewHistogramVec(prometheus.HistogramOpts{
+		Namespace: metricsNamespace,
+		Name:      "job_wait_duration_seconds",
+		Help:      "Time spent waiting for Variomedia's DNS jobs to finish, by outcome.",
+		Buckets:   []float64{0.5, 1, 2.5, 5, 10, 15, 20, 30, 45, 60, 90},
+	}, []string{"outcome"})
+
+	rateLimitHitsTotal = prometheus.NewCounterVec(prometheus.CounterOpts{
+		Namespace: metricsNamespace,
+		Name:      "rate_limit_hits_total",
+		Help:      "Number of requests delayed by a rate limit, by who enforced it (client or variomedia).",
+	}, []string{"limiter"})
+)
+
+// outcome maps an error to the outcome label
+func outcome(err error) string {
+	if err != nil {
+		return outcomeError
+	}
+	return outcomeSuccess
+}
+
+// observeChallenge records a presented or cleaned up challenge
+func observeChallenge(operation, domain string, start time.Time, err error) {
+	if domain == "" {
+		domain = unknownDomain
+	}
+	challengesTotal.WithLabelValues(operation, domain, outcome(err)).Inc()
+	challengeDuration.WithLabelValues(operation, domain, outcome(err)).Observe(time.Since(start).Seconds())
+}
+
+// observeApiRequest records an HTTP request to the Variomedia API - res is nil if the
+// request got no response
+func observeApiRequest(method string, res *http.Response, start time.Time) {
+	status := statusNoResponse
+	if res != nil {
+		status = strconv.Itoa(res.StatusCode)
+	}
+	apiRequestsTotal.WithLabelValues(method, status).Inc()
+	apiRequestDuration.WithLabelValues(method).Observe(time.Since(start).Seconds())
+}
+
+// newMetricsRegistry gathers the webhook's metrics, including the number of challenge
+// records currently tracked by the solver
+func (c *customDNSProviderSolver) newMetricsRegistry() *prometheus.Registry {
+	registry := prometheus.NewRegistry()
+	registry.MustRegister(
+		prometheus.NewGoCollector(),
+		prometheus.NewProcessCollector(prometheus.ProcessCollectorOpts{}),
+		challengesTotal,
+		challengeDuration,
+		apiRequestsTotal,
+		apiRequestDuration,
+		jobWaitDuration,
+		rateLimitHitsTotal,
+		prometheus.NewGaugeFunc(prometheus.GaugeOpts{
+			Namespace: metricsNamespace,
+			Name:      "tracked_records",
+			Help:      "Number of TXT records presented and not yet cleaned up.",
+		}, func() float64 {
+			return float64(c.entries.len())
+		}),
+	)
+	return registry
+}
+
+// serveMetrics serves the metrics and the health endpoints on the address (i.e. ":9402")
+// until stopCh is closed. Readiness is only served with a readiness checker.
+func (c *customDNSProviderSolver) serveMetrics(address string, stopCh <-chan struct{}) error {
+	klog.V(4).InfoS("serveMetrics() called")
+	klog.V(5).InfoS("parameters", "address", address)
+
+	listener, err := net.Listen("tcp", address)
+	if err != nil {
+		klog.ErrorS(err, "serveMetrics() finished with error")
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.Handle(metricsPath, promhttp.HandlerFor(c.newMetricsRegistry(), promhttp.HandlerOpts{}))
+	mux.HandleFunc(healthzPath, serveHealthz)
+	if c.readiness != nil {
+		mux.HandleFunc(readyzPath, c.readiness.serveReadyz)
+	}
+	server := &http.Server{Handler: mux}
+
+	go func() {
+		if err := server.Serve(listener); err != nil && err != http.ErrServerClosed {
+			klog.ErrorS(err, "metrics server stopped with error")
+		}
+	}()
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), metricsShutdownTimeout)
+		defer cancel()
+		server.Shutdown(ctx)
+	}()
+
+	klog.V(2).InfoS("serving metrics", "address", listener.Addr().String(), "path", metricsPath)
+	klog.V(4).InfoS("serveMetrics() finished")
+	return nil
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+func TestMetrics_Challenges(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	registry := solver.newMetricsRegistry()
+
+	presented := challengesTotal.WithLabelValues(operationPresent, "example.com", outcomeSuccess)
+	cleanedUp := challengesTotal.WithLabelValues(operationCleanUp, "example.com", outcomeSuccess)
+	failed := challengesTotal.WithLabelValues(operationPresent, unknownDomain, outcomeError)
+	posted := apiRequestsTotal.WithLabelValues(http.MethodPost, "202")
+	before := []float64{testutil.ToFloat64(presented), testutil.ToFloat64(cleanedUp), testutil.ToFloat64(failed), testutil.ToFloat64(posted)}
+
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	require.NoError(t, solver.Present(ch))
+	assert.Equal(t, before[0]+1, testutil.ToFloat64(presented))
+	assert.Equal(t, before[3]+1, testutil.ToFloat64(posted))
+	assertTrackedRecords(t, registry, 1)
+
+	require.NoError(t, solver.CleanUp(ch))
+	assert.Equal(t, before[1]+1, testutil.ToFloat64(cleanedUp))
+	assertTrackedRecords(t, registry, 0)
+
+	// the domain of challenges failing early is not known
+	assert.Error(t, solver.Present(newTestChallenge("example.net.", "_acme-challenge.example.net.", "challenge-key")))
+	assert.Equal(t, before[2]+1, testutil.ToFloat64(failed))
+}
+
+// assertTrackedRecords checks the current value of the tracked records gauge
+func assertTrackedRecords(t *testing.T, registry prometheus.Gatherer, expected int) {
+	name := metricsNamespace + "_tracked_records"
+	assert.NoError(t, testutil.GatherAndCompare(registry, strings.NewReader(fmt.Sprintf(`
+# HELP %s Number of TXT records presented and not yet cleaned up.
+# TYPE %s gauge
+%s %d
+`, name, name, name, expected)), name))
+}
+
+func TestServeMetrics(t *testing.T) {
+	// find a free port
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	require.NoError(t, err)
+	address := listener.Addr().String()
+	listener.Close()
+
+	solver := &customDNSProviderSolver{}
+	stopCh := make(chan struct{})
+	require.NoError(t, solver.serveMetrics(address, stopCh))
+
+	res, err := http.Get("http://" + address + metricsPath)
+	require.NoError(t, err)
+	body, err := ioutil.ReadAll(res.Body)
+	res.Body.Close()
+	require.NoError(t, err)
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	assert.Contains(t, string(body), metricsNamespace+"_tracked_records 0")
+
+	// the health endpoint is served along with the metrics
+	res, err = http.Get("http://" + address + healthzPath)
+	require.NoError(t, err)
+	res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+
+	// the server stops with the webhook
+	close(stopCh)
+	assert.Eventually(t, func() bool {
+		_, err := http.Get("http://" + address + metricsPath)
+		return err != nil
+	}, 5*time.Second, 10*time.Millisecond)
+}
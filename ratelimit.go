@@ -0,0 +1,147 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// staying within (and coping with) Variomedia's request rate limit
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"golang.org/x/time/rate"
+)
+
+const (
+	// default client-side limit for requests per API key
+	defaultApiRateLimit = 5 // requests per second
+	defaultApiRateBurst = 10
+	// how often a request answered with HTTP status 429 is retried
+	maxRateLimitRetries = 5
+	// delay before retrying if Variomedia doesn't tell us how long to wait
+	defaultRateLimitDelay = time.Second
+	// the longest delay we accept before retrying if the request has no deadline
+	maxRateLimitDelay = time.Minute
+)
+
+// apiKeyRateLimiters hands out one token bucket per Variomedia API key, so that all
+// requests made with the same key share a common limit
+type apiKeyRateLimiters struct {
+	sync.Mutex
+	limit    rate.Limit
+	burst    int
+	limiters map[[sha256.Size]byte]*rate.Limiter
+}
+
+// newApiKeyRateLimiters creates token buckets allowing limit requests per second,
+// with bursts of up to burst requests
+func newApiKeyRateLimiters(limit rate.Limit, burst int) *apiKeyRateLimiters {
+	return &apiKeyRateLimiters{
+		limit:    limit,
+		burst:    burst,
+		limiters: make(map[[sha256.Size]byte]*rate.Limiter),
+	}
+}
+
+// get returns the token bucket for the API key, creating it if necessary. The key
+// itself is not kept, only its hash.
+func (l *apiKeyRateLimiters) get(apiKey variomediaApiKey) *rate.Limiter {
+	l.Lock()
+	defer l.Unlock()
+	hash := apiKey.hash()
+	limiter, ok := l.limiters[hash]
+	if !ok {
+		limiter = rate.NewLimiter(l.limit, l.burst)
+		l.limiters[hash] = limiter
+	}
+	return limiter
+}
+
+// forget drops the token bucket of the API key, i.e. when the key is no longer in use
+func (l *apiKeyRateLimiters) forget(apiKey variomediaApiKey) {
+	l.Lock()
+	defer l.Unlock()
+	delete(l.limiters, apiKey.hash())
+}
+
+// waitForRateLimiter blocks until the token bucket permits the next request, like
+// rate.Limiter.Wait(), but counts the requests it had to delay
+func waitForRateLimiter(ctx context.Context, limiter *rate.Limiter) error {
+	reservation := limiter.Reserve()
+	if !reservation.OK() {
+		return fmt.Errorf("rate limiter permits no requests")
+	}
+	delay := reservation.Delay()
+	if delay == 0 {
+		return nil
+	}
+	rateLimitHitsTotal.WithLabelValues(rateLimitClient).Inc()
+
+	if deadline, ok := ctx.Deadline(); ok && time.Now().Add(delay).After(deadline) {
+		reservation.Cancel()
+		return fmt.Errorf("rate limit would delay the request by %v, beyond the deadline", delay)
+	}
+	select {
+	case <-ctx.Done():
+		reservation.Cancel()
+		return ctx.Err()
+	case <-time.After(delay):
+		return nil
+	}
+}
+
+// rateLimitRetryDelay determines how long to wait before retrying a request that hit
+// the rate limit, from the "Retry-After" or rate limit reset headers of the response.
+// It reports false if the retry would not happen before the context's deadline.
+func rateLimitRetryDelay(ctx context.Context, header http.Header, now time.Time) (time.Duration, bool) {
+	delay := retryAfter(header, now)
+	if deadline, ok := ctx.Deadline(); ok {
+		return delay, now.Add(delay).Before(deadline)
+	}
+	return delay, delay <= maxRateLimitDelay
+}
+
+// retryAfter evaluates the headers telling when to retry after hitting the rate limit
+func retryAfter(header http.Header, now time.Time) time.Duration {
+	// "Retry-After" is either a number of seconds or an HTTP date
+	if value := header.Get("Retry-After"); value != "" {
+		if seconds, err := strconv.Atoi(value); err == nil && seconds >= 0 {
+			return time.Duration(seconds) * time.Second
+		}
+		if t, err := http.ParseTime(value); err == nil {
+			return nonNegative(t.Sub(now))
+		}
+	}
+
+	// the rate limit reset headers are in seconds - some APIs report a point in
+	// time (seconds since the epoch) instead of a delay
+	for _, name := range []string{"RateLimit-Reset", "X-RateLimit-Reset"} {
+		value := header.Get(name)
+		if value == "" {
+			continue
+		}
+		seconds, err := strconv.ParseInt(value, 10, 64)
+		if err != nil || seconds < 0 {
+			continue
+		}
+		if seconds > now.Unix()/2 {
+			return nonNegative(time.Unix(seconds, 0).Sub(now))
+		}
+		return time.Duration(seconds) * time.Second
+	}
+
+	return defaultRateLimitDelay
+}
+
+func nonNegative(d time.Duration) time.Duration {
+	if d < 0 {
+		return 0
+	}
+	return d
+}
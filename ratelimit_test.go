@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus/testutil"
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"golang.org/x/time/rate"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+func TestRetryAfter(t *testing.T) {
+	now := time.Date(2022, 3, 1, 12, 0, 0, 0, time.UTC)
+	tests := []struct {
+		name   string
+		header http.Header
+		delay  time.Duration
+	}{
+		{"none", http.Header{}, defaultRateLimitDelay},
+		{"seconds", http.Header{"Retry-After": {"3"}}, 3 * time.Second},
+		{"date", http.Header{"Retry-After": {now.Add(5 * time.Second).Format(http.TimeFormat)}}, 5 * time.Second},
+		{"past date", http.Header{"Retry-After": {now.Add(-5 * time.Second).Format(http.TimeFormat)}}, 0},
+		{"reset delay", http.Header{"X-Ratelimit-Reset": {"7"}}, 7 * time.Second},
+		{"reset time", http.Header{"Ratelimit-Reset": {"1646136010"}}, 10 * time.Second},
+		{"invalid", http.Header{"Retry-After": {"soon"}}, defaultRateLimitDelay},
+	}
+	for _, test := range tests {
+		assert.Equal(t, test.delay, retryAfter(test.header, now), test.name)
+	}
+}
+
+func TestRateLimitRetryDelay(t *testing.T) {
+	now := time.Now()
+	header := http.Header{"Retry-After": {"2"}}
+
+	_, ok := rateLimitRetryDelay(context.Background(), header, now)
+	assert.True(t, ok)
+
+	ctx, cancel := context.WithDeadline(context.Background(), now.Add(time.Second))
+	defer cancel()
+	_, ok = rateLimitRetryDelay(ctx, header, now)
+	assert.False(t, ok, "retry must not happen after the deadline")
+
+	_, ok = rateLimitRetryDelay(context.Background(), http.Header{"Retry-After": {"3600"}}, now)
+	assert.False(t, ok)
+}
+
+func TestApiKeyRateLimiters(t *testing.T) {
+	limiters := newApiKeyRateLimiters(rate.Limit(1), 1)
+	assert.Same(t, limiters.get(newVariomediaApiKey("key1")), limiters.get(newVariomediaApiKey("key1")))
+	assert.NotSame(t, limiters.get(newVariomediaApiKey("key1")), limiters.get(newVariomediaApiKey("key2")))
+
+	limiter := limiters.get(newVariomediaApiKey("key1"))
+	limiters.forget(newVariomediaApiKey("key1"))
+	assert.NotSame(t, limiter, limiters.get(newVariomediaApiKey("key1")))
+}
+
+func TestVariomediaClient_RetryOnRateLimit(t *testing.T) {
+	fake := fakevariomedia.NewTest(t, "key")
+	baseUrl := fake.URL()
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(baseUrl))
+	domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+
+	// the fake asks to retry after one second
+	hits := testutil.ToFloat64(rateLimitHitsTotal.WithLabelValues(rateLimitVariomedia))
+	fake.Throttle(1)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	_, err := client.UpdateTxtRecord(ctx, &domain, &name, &value, variomediaMinTtl)
+	require.NoError(t, err, "request body must be sent again on retry")
+	assert.Len(t, fake.Records(), 1)
+	assert.Equal(t, 1, fake.RateLimitHits())
+	assert.Equal(t, hits+1, testutil.ToFloat64(rateLimitHitsTotal.WithLabelValues(rateLimitVariomedia)))
+
+	// no retry if the deadline doesn't permit it
+	fake.Throttle(1)
+	ctx, cancel = context.WithTimeout(context.Background(), 500*time.Millisecond)
+	defer cancel()
+	_, err = client.UpdateTxtRecord(ctx, &domain, &name, &value, variomediaMinTtl)
+	assert.Error(t, err)
+}
+
+func TestVariomediaClient_RateLimiter(t *testing.T) {
+	fake := fakevariomedia.NewTest(t, "key")
+	fake.RateLimit = 2
+	fake.RateLimitWindow = time.Second
+	baseUrl := fake.URL()
+
+	// the client-side limit keeps us below the server's limit
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(baseUrl), WithRateLimiter(rate.NewLimiter(rate.Limit(1.5), 1)))
+	hits := testutil.ToFloat64(rateLimitHitsTotal.WithLabelValues(rateLimitClient))
+	domain, name := "example.com", "_acme-challenge"
+	for i := 0; i < 4; i++ {
+		value := "challenge-key"
+		_, err := client.FindTxtRecord(context.Background(), &domain, &name, &value)
+		assert.NoError(t, err)
+	}
+	assert.Equal(t, 0, fake.RateLimitHits())
+	assert.Equal(t, hits+3, testutil.ToFloat64(rateLimitHitsTotal.WithLabelValues(rateLimitClient)), "all but the first request were delayed")
+}
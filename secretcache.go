@@ -0,0 +1,249 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// watch-based cache of the secrets holding the API keys
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/fields"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/tools/cache"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// maximum duration of waiting for a newly watched secret to be loaded, before it is
+	// read from the API server directly
+	secretSyncTimeout = 5 * time.Second
+	// how long a secret is watched after its last use
+	secretIdleTimeout = time.Hour
+)
+
+// secretCache keeps the referenced secrets up to date via watches, so challenges don't
+// cause API server requests and rotated API keys are used right away.
+// Each secret gets its own informer, limited to the secret's name, so the webhook needs
+// no permission to list all secrets of a namespace. Secrets that cannot be watched (i.e.
+// without permission to list and watch them) are read from the API server each time.
+type secretCache struct {
+	sync.Mutex
+	client kubernetes.Interface
+	// closed when the webhook is stopped, ending all watches
+	stopCh <-chan struct{}
+	// called with the previous value of a secret's referenced data key whenever it changes
+	// or the secret is deleted
+	onRotate func(secret types.NamespacedName, key string, oldValue string)
+	secrets  map[types.NamespacedName]*watchedSecret
+}
+
+// watchedSecret is the informer of a single secret
+type watchedSecret struct {
+	informer cache.SharedIndexInformer
+	// closed to stop the informer
+	stopCh   chan struct{}
+	lastUsed time.Time
+	// the data keys read from the secret, only their changes are reported
+	keys map[string]bool
+	// set once listing the secret was forbidden, the informer is stopped then
+	forbidden bool
+}
+
+// newSecretCache creates a secret cache whose watches end when stopCh is closed
+func newSecretCache(client kubernetes.Interface, stopCh <-chan struct{}, onRotate func(types.NamespacedName, string, string)) *secretCache {
+	c := &secretCache{
+		client:   client,
+		stopCh:   stopCh,
+		onRotate: onRotate,
+		secrets:  make(map[types.NamespacedName]*watchedSecret),
+	}
+	go c.run()
+	return c
+}
+
+// get returns the secret to read the data key from, starting to watch it on first use.
+// If the secret cannot be loaded by its informer in time, it is read from the API server
+// directly.
+func (c *secretCache) get(ctx context.Context, namespace, name, key string) (*corev1.Secret, error) {
+	secret := types.NamespacedName{Namespace: namespace, Name: name}
+	informer := c.informer(secret, key)
+	if informer == nil {
+		return c.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+	}
+
+	if !informer.HasSynced() {
+		syncCtx, cancel := context.WithTimeout(ctx, secretSyncTimeout)
+		synced := cache.WaitForCacheSync(syncCtx.Done(), func() bool {
+			return informer.HasSynced() || c.isForbidden(secret)
+		})
+		cancel()
+		if !synced || !informer.HasSynced() {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("timed out waiting for secret `%s/%s` to be loaded: %v", namespace, name, ctx.Err())
+			}
+			klog.V(2).InfoS("secret not loaded by watch in time, reading it directly", "secret", secret)
+			return c.client.CoreV1().Secrets(namespace).Get(ctx, name, metav1.GetOptions{})
+		}
+	}
+
+	obj, exists, err := informer.GetStore().GetByKey(namespace + "/" + name)
+	if err != nil {
+		return nil, err
+	}
+	if !exists {
+		return nil, apierrors.NewNotFound(corev1.Resource("secrets"), name)
+	}
+	return obj.(*corev1.Secret), nil
+}
+
+// informer returns the (started) informer of the secret the data key is read from,
+// creating it if necessary, nil if the secret cannot be watched
+func (c *secretCache) informer(secret types.NamespacedName, key string) cache.SharedIndexInformer {
+	c.Lock()
+	defer c.Unlock()
+
+	if watched, ok := c.secrets[secret]; ok {
+		watched.lastUsed = time.Now()
+		watched.keys[key] = true
+		if watched.forbidden {
+			return nil
+		}
+		return watched.informer
+	}
+
+	klog.V(4).InfoS("watching secret", "secret", secret)
+	factory := informers.NewSharedInformerFactoryWithOptions(c.client, 0,
+		informers.WithNamespace(secret.Namespace),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.FieldSelector = fields.OneTermEqualSelector("metadata.name", secret.Name).String()
+		}))
+	informer := factory.Core().V1().Secrets().Informer()
+	informer.AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			c.secretChanged(secret, oldObj, newObj)
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			c.secretChanged(secret, obj, nil)
+		},
+	})
+	informer.SetWatchErrorHandler(func(_ *cache.Reflector, err error) {
+		if apierrors.IsForbidden(err) {
+			c.forbidden(secret, err)
+		}
+	})
+	watched := &watchedSecret{informer: informer, stopCh: make(chan struct{}), lastUsed: time.Now(), keys: map[string]bool{key: true}}
+	factory.Start(watched.stopCh)
+
+	c.secrets[secret] = watched
+	return informer
+}
+
+// forbidden stops the informer of a secret the webhook may not list or watch, so the
+// secret is read directly from now on
+func (c *secretCache) forbidden(secret types.NamespacedName, err error) {
+	c.Lock()
+	defer c.Unlock()
+	watched, ok := c.secrets[secret]
+	if !ok || watched.forbidden {
+		return
+	}
+	klog.ErrorS(err, "not allowed to watch secret, reading it directly", "secret", secret)
+	watched.forbidden = true
+	close(watched.stopCh)
+}
+
+// isForbidden reports whether the webhook may not watch the secret
+func (c *secretCache) isForbidden(secret types.NamespacedName) bool {
+	c.Lock()
+	defer c.Unlock()
+	watched, ok := c.secrets[secret]
+	return ok && watched.forbidden
+}
+
+// run stops watching secrets once they were not used for a while, and all of them
+// when the webhook is stopped
+func (c *secretCache) run() {
+	ticker := time.NewTicker(secretIdleTimeout / 4)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-c.stopCh:
+			c.evictIdle(time.Time{}, true)
+			return
+		case now := <-ticker.C:
+			c.evictIdle(now, false)
+		}
+	}
+}
+
+// evictIdle stops the informers of the secrets not used within the idle timeout before
+// now (or all of them), so they are watched again on their next use
+func (c *secretCache) evictIdle(now time.Time, all bool) {
+	c.Lock()
+	defer c.Unlock()
+	for secret, watched := range c.secrets {
+		if !all && now.Sub(watched.lastUsed) < secretIdleTimeout {
+			continue
+		}
+		klog.V(4).InfoS("no longer watching secret", "secret", secret)
+		if !watched.forbidden {
+			close(watched.stopCh)
+		}
+		delete(c.secrets, secret)
+	}
+}
+
+// referencedKeys returns the data keys read from the secret
+func (c *secretCache) referencedKeys(secret types.NamespacedName) map[string]bool {
+	c.Lock()
+	defer c.Unlock()
+	keys := make(map[string]bool)
+	if watched, ok := c.secrets[secret]; ok {
+		for key := range watched.keys {
+			keys[key] = true
+		}
+	}
+	return keys
+}
+
+// secretChanged reports each referenced data key whose value was changed or removed -
+// other keys of the secret are of no concern to the webhook
+func (c *secretCache) secretChanged(secret types.NamespacedName, oldObj, newObj interface{}) {
+	oldSecret, ok := oldObj.(*corev1.Secret)
+	if !ok || oldSecret.Name != secret.Name {
+		return
+	}
+	referenced := c.referencedKeys(secret)
+	newData := map[string][]byte{}
+	if newSecret, ok := newObj.(*corev1.Secret); ok {
+		newData = newSecret.Data
+	}
+
+	for key, oldValue := range oldSecret.Data {
+		if !referenced[key] {
+			continue
+		}
+		newValue, ok := newData[key]
+		if ok && string(newValue) == string(oldValue) {
+			continue
+		}
+		// the value is the API key, so it must not end up in the log
+		klog.V(2).InfoS("API key in secret changed", "secret", secret, "key", key, "removed", !ok)
+		if c.onRotate != nil {
+			c.onRotate(secret, key, string(oldValue))
+		}
+	}
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes/fake"
+	k8stesting "k8s.io/client-go/testing"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+func TestSecretCache_Rotation(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "variomedia-credentials", Namespace: "default"},
+		Data:       map[string][]byte{"api-token": []byte("old-token"), "other": []byte("unchanged")},
+	}
+	client := fake.NewSimpleClientset(secret)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+
+	var mu sync.Mutex
+	var rotated []string
+	cache := newSecretCache(client, stopCh, func(secret types.NamespacedName, key, oldValue string) {
+		mu.Lock()
+		defer mu.Unlock()
+		rotated = append(rotated, secret.String()+":"+key+":"+oldValue)
+	})
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	got, err := cache.get(ctx, "default", "variomedia-credentials", "api-token")
+	require.NoError(t, err)
+	assert.Equal(t, "old-token", string(got.Data["api-token"]))
+
+	_, err = cache.get(ctx, "default", "missing", "api-token")
+	assert.True(t, apierrors.IsNotFound(err), "unexpected error %v", err)
+
+	// the fake clientset loses changes made before the watch is established, so the
+	// update is repeated until it is seen
+	updated := secret.DeepCopy()
+	updated.Data["api-token"] = []byte("new-token")
+	// keys not referenced by any secretRef are not reported
+	updated.Data["other"] = []byte("changed")
+	assert.Eventually(t, func() bool {
+		_, err = client.CoreV1().Secrets("default").Update(ctx, updated, metav1.UpdateOptions{})
+		require.NoError(t, err)
+		got, err := cache.get(ctx, "default", "variomedia-credentials", "api-token")
+		return err == nil && string(got.Data["api-token"]) == "new-token"
+	}, 5*time.Second, 10*time.Millisecond)
+	assert.Eventually(t, func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return assert.ObjectsAreEqual([]string{"default/variomedia-credentials:api-token:old-token"}, rotated)
+	}, 5*time.Second, 10*time.Millisecond)
+
+	require.NoError(t, client.CoreV1().Secrets("default").Delete(ctx, "variomedia-credentials", metav1.DeleteOptions{}))
+	assert.Eventually(t, func() bool {
+		_, err := cache.get(ctx, "default", "variomedia-credentials", "api-token")
+		return apierrors.IsNotFound(err)
+	}, 5*time.Second, 10*time.Millisecond)
+}
+
+func TestSecretCache_Forbidden(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "variomedia-credentials", Namespace: "default"},
+		Data:       map[string][]byte{"api-token": []byte("token")},
+	}
+	client := fake.NewSimpleClientset(secret)
+	client.PrependReactor("list", "secrets", func(action k8stesting.Action) (bool, runtime.Object, error) {
+		return true, nil, apierrors.NewForbidden(corev1.Resource("secrets"), "", errors.New("no RBAC"))
+	})
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cache := newSecretCache(client, stopCh, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*secretSyncTimeout)
+	defer cancel()
+
+	// secrets that may not be watched are read directly, without waiting for the watch
+	start := time.Now()
+	got, err := cache.get(ctx, "default", "variomedia-credentials", "api-token")
+	require.NoError(t, err)
+	assert.Equal(t, "token", string(got.Data["api-token"]))
+	assert.Less(t, int64(time.Since(start)), int64(secretSyncTimeout))
+	assert.True(t, cache.isForbidden(types.NamespacedName{Namespace: "default", Name: "variomedia-credentials"}))
+
+	got, err = cache.get(ctx, "default", "variomedia-credentials", "api-token")
+	require.NoError(t, err)
+	assert.Equal(t, "token", string(got.Data["api-token"]))
+}
+
+func TestSecretCache_EvictIdle(t *testing.T) {
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: "variomedia-credentials", Namespace: "default"},
+		Data:       map[string][]byte{"api-token": []byte("token")},
+	}
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	cache := newSecretCache(fake.NewSimpleClientset(secret), stopCh, nil)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err := cache.get(ctx, "default", "variomedia-credentials", "api-token")
+	require.NoError(t, err)
+	cache.evictIdle(time.Now(), false)
+	assert.Len(t, cache.secrets, 1, "secret in use was evicted")
+
+	cache.evictIdle(time.Now().Add(secretIdleTimeout), false)
+	assert.Empty(t, cache.secrets)
+
+	// evicted secrets are watched again on their next use
+	got, err := cache.get(ctx, "default", "variomedia-credentials", "api-token")
+	require.NoError(t, err)
+	assert.Equal(t, "token", string(got.Data["api-token"]))
+	assert.Len(t, cache.secrets, 1)
+}
+
+func TestPresent_RotatedApiKey(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "new-api-token")
+	solver := newTestSolver(fakeApi, "old-api-token")
+	solver.rateLimiters = newApiKeyRateLimiters(defaultApiRateLimit, defaultApiRateBurst)
+	stopCh := make(chan struct{})
+	defer close(stopCh)
+	solver.secrets = newSecretCache(solver.client, stopCh, solver.apiKeyRotated)
+
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "key")
+	assert.Error(t, solver.Present(ch), "the old API key is rejected by Variomedia")
+	oldLimiter := solver.rateLimiters.get(newVariomediaApiKey("old-api-token"))
+
+	// no restart needed to pick up the new key - the update is repeated as the fake
+	// clientset loses changes made before the watch is established
+	assert.Eventually(t, func() bool {
+		_, err := solver.client.CoreV1().Secrets("default").Update(context.Background(), &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: "variomedia-credentials", Namespace: "default"},
+			Data:       map[string][]byte{"api-token": []byte("new-api-token\n")},
+		}, metav1.UpdateOptions{})
+		require.NoError(t, err)
+		return solver.Present(ch) == nil
+	}, 5*time.Second, 50*time.Millisecond)
+	assert.Len(t, fakeApi.Records(), 1)
+	assert.NotSame(t, oldLimiter, solver.rateLimiters.get(newVariomediaApiKey("old-api-token")), "state of the old API key was not dropped")
+	require.NoError(t, solver.CleanUp(ch))
+}
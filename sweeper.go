@@ -0,0 +1,392 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// sweeping orphaned _acme-challenge TXT records left behind by failed or skipped clean ups
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/kubernetes"
+	"k8s.io/client-go/util/retry"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// how long a record has to be seen orphaned before it is deleted
+	defaultSweepMinAge = 24 * time.Hour
+	// maximum number of records deleted per sweep
+	defaultSweepMaxDeletions = 10
+	// name of the TXT records of DNS-01 challenges
+	challengeEntryPrefix = "_acme-challenge"
+	// key of the sweeper's state in its ConfigMap
+	sweeperStateKey = "state.json"
+)
+
+// sweepDomain is a domain seen in a challenge, with what is needed to list its records
+type sweepDomain struct {
+	name   string
+	config variomediaDomainConfig
+	// the challenge's resource namespace, the secret reference is resolved in
+	namespace string
+}
+
+// orphanedRecord is a challenge record found by a sweep that no challenge is using
+type orphanedRecord struct {
+	domain string
+	entry  string
+	url    string
+	// how long the record has been seen orphaned
+	age     time.Duration
+	deleted bool
+}
+
+// orphanSighting is when an orphaned record of the domain was first found
+type orphanSighting struct {
+	Domain string    `json:"domain"`
+	Time   time.Time `json:"time"`
+}
+
+// sweeperState is what the sweeper keeps in its ConfigMap, so a restart neither forgets
+// the domains to sweep nor restarts the age of the orphaned records
+type sweeperState struct {
+	Domains []sweeperStateDomain `json:"domains"`
+	// when each orphaned record was first found, by URL
+	FirstSeen map[string]orphanSighting `json:"firstSeen"`
+}
+
+// sweeperStateDomain is a domain to sweep as kept in the sweeper's ConfigMap
+type sweeperStateDomain struct {
+	Name      string                 `json:"name"`
+	Namespace string                 `json:"namespace"`
+	Config    variomediaDomainConfig `json:"config"`
+}
+
+// recordSweeper periodically deletes the _acme-challenge TXT records of the domains
+// seen in challenges that no challenge is using anymore.
+// Variomedia doesn't report when a record was created, so a record's age is counted
+// from the sweep that first found it orphaned. Records of challenges cached by this
+// replica and those of all existing Challenge resources are never deleted.
+// With a state ConfigMap, the domains and the ages of orphaned records are kept there
+// (shared by all replicas), else they are lost on restart.
+type recordSweeper struct {
+	sync.Mutex
+	solver *customDNSProviderSolver
+	// to look up the keys of all existing Challenges
+	challenges   *challengeStore
+	interval     time.Duration
+	minAge       time.Duration
+	dryRun       bool
+	maxDeletions int
+	domains      map[string]sweepDomain
+	// when each orphaned record was first found, by URL
+	firstSeen map[string]orphanSighting
+	// where to keep the state, no ConfigMap if the name is empty
+	configMaps     kubernetes.Interface
+	stateConfigMap types.NamespacedName
+}
+
+// newRecordSweeper creates a sweeper for the solver's records
+func newRecordSweeper(solver *customDNSProviderSolver, challenges *challengeStore, interval, minAge time.Duration, dryRun bool, maxDeletions int) *recordSweeper {
+	return &recordSweeper{
+		solver:       solver,
+		challenges:   challenges,
+		interval:     interval,
+		minAge:       minAge,
+		dryRun:       dryRun,
+		maxDeletions: maxDeletions,
+		domains:      make(map[string]sweepDomain),
+		firstSeen:    make(map[string]orphanSighting),
+	}
+}
+
+// recordSweeperFromEnv creates a sweeper with the settings from the webhook's
+// environment, nil if sweeping is not enabled
+func recordSweeperFromEnv(solver *customDNSProviderSolver, challenges *challengeStore, configMaps kubernetes.Interface) (*recordSweeper, error) {
+	interval, err := durationFromEnv(envSweepInterval, 0)
+	if err != nil || interval == 0 {
+		return nil, err
+	}
+	minAge, err := durationFromEnv(envSweepMinAge, defaultSweepMinAge)
+	if err != nil {
+		return nil, err
+	}
+	dryRun := false
+	if value := os.Getenv(envSweepDryRun); value != "" {
+		dryRun, err = strconv.ParseBool(value)
+		if err != nil {
+			return nil, fmt.Errorf("invalid %s `%s`: must be true or false", envSweepDryRun, value)
+		}
+	}
+	maxDeletions, err := positiveIntFromEnv(envSweepMaxDeletions, defaultSweepMaxDeletions)
+	if err != nil {
+		return nil, err
+	}
+	sweeper := newRecordSweeper(solver, challenges, interval, minAge, dryRun, maxDeletions)
+	if value := os.Getenv(envSweepStateConfigMap); value != "" {
+		parts := strings.Split(value, "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			return nil, fmt.Errorf("invalid %s `%s`: must be <namespace>/<name>", envSweepStateConfigMap, value)
+		}
+		sweeper.configMaps = configMaps
+		sweeper.stateConfigMap = types.NamespacedName{Namespace: parts[0], Name: parts[1]}
+	}
+	return sweeper, nil
+}
+
+// domainUsed notes that a challenge used the domain, so its records are swept from now on
+func (s *recordSweeper) domainUsed(domain string, config variomediaDomainConfig, namespace string) {
+	if s == nil {
+		return
+	}
+	s.Lock()
+	defer s.Unlock()
+	s.domains[domain] = sweepDomain{name: domain, config: config, namespace: namespace}
+}
+
+// run sweeps once per interval until stopCh is closed
+func (s *recordSweeper) run(stopCh <-chan struct{}) {
+	klog.V(2).InfoS("sweeping orphaned challenge records", "interval", s.interval, "minimum age", s.minAge, "dry run", s.dryRun, "maximum deletions", s.maxDeletions)
+	ticker := time.NewTicker(s.interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-stopCh:
+			return
+		case <-ticker.C:
+		}
+
+		ctx, cancel := context.WithTimeout(s.solver.ctx, s.interval)
+		if _, err := s.sweep(ctx); err != nil {
+			klog.ErrorS(err, "unable to sweep orphaned challenge records")
+		}
+		cancel()
+	}
+}
+
+// sweep finds the orphaned challenge records of all domains and deletes those seen for
+// at least the minimum age, up to the maximum number of deletions - in dry run mode,
+// they are only reported. It returns the records old enough to be deleted.
+func (s *recordSweeper) sweep(ctx context.Context) ([]orphanedRecord, error) {
+	klog.V(4).InfoS("sweep() called")
+
+	// without the stored state, only records found orphaned from now on are deleted
+	if err := s.loadState(ctx); err != nil {
+		klog.ErrorS(err, "unable to load sweeper state")
+	}
+	// records of all existing Challenges are kept, even if another replica presented them
+	active, err := s.challenges.keys()
+	if err != nil {
+		klog.ErrorS(err, "sweep() finished with error")
+		return nil, err
+	}
+
+	s.Lock()
+	var domains []sweepDomain
+	for _, domain := range s.domains {
+		domains = append(domains, domain)
+	}
+	s.Unlock()
+	sort.Slice(domains, func(i, j int) bool { return domains[i].name < domains[j].name })
+
+	now := time.Now()
+	// records found orphaned, by URL, and the domains whose records were listed
+	found := make(map[string]bool)
+	listed := make(map[string]bool)
+	deletions := 0
+	var orphans []orphanedRecord
+	for _, domain := range domains {
+		apiKey, err := s.solver.loadApiKey(ctx, domain.name, domain.config.SecretRef, domain.namespace)
+		if err != nil {
+			klog.ErrorS(err, "unable to sweep domain", "domain", domain.name)
+			continue
+		}
+		client := s.solver.newVariomediaClient(apiKey, domain.config.variomediaSettings)
+		records, err := client.ListTxtRecords(ctx, &domain.name)
+		if err != nil {
+			klog.ErrorS(err, "unable to sweep domain", "domain", domain.name)
+			continue
+		}
+		listed[domain.name] = true
+
+		for _, record := range records {
+			entry, value := record.Attributes.Name, record.Attributes.Data
+			if !isChallengeEntry(entry) || active[value] || s.solver.entries.get(domain.name, entry, value) != "" {
+				continue
+			}
+			url := client.listedRecordUrl(record)
+			found[url] = true
+			orphan := orphanedRecord{domain: domain.name, entry: entry, url: url, age: now.Sub(s.seen(domain.name, url, now))}
+			if orphan.age < s.minAge {
+				continue
+			}
+
+			switch {
+			case s.dryRun:
+				klog.InfoS("found orphaned challenge record, not deleted in dry run", "domain", domain.name, "entry", entry, "url", url, "age", orphan.age)
+			case deletions >= s.maxDeletions:
+				klog.V(2).InfoS("found orphaned challenge record, deletion limit reached", "domain", domain.name, "entry", entry, "url", url, "age", orphan.age)
+			default:
+				deletions++
+				event := newSweepAuditEvent(domain.name, entry, value)
+				err := client.DeleteTxtRecord(ctx, url)
+				event.RecordUrl, event.JobId = url, client.lastJobId
+				s.solver.audit.record(event, err)
+				if err != nil {
+					klog.ErrorS(err, "unable to delete orphaned challenge record", "domain", domain.name, "entry", entry, "url", url)
+					break
+				}
+				klog.InfoS("deleted orphaned challenge record", "domain", domain.name, "entry", entry, "url", url, "age", orphan.age)
+				orphan.deleted = true
+				delete(found, url)
+			}
+			orphans = append(orphans, orphan)
+		}
+	}
+
+	// records deleted, gone or taken over by a challenge are forgotten - those of domains
+	// that could not be listed are kept, so their age is not counted anew
+	s.Lock()
+	for url, sighting := range s.firstSeen {
+		if listed[sighting.Domain] && !found[url] {
+			delete(s.firstSeen, url)
+		}
+	}
+	s.Unlock()
+	if err := s.saveState(ctx); err != nil {
+		klog.ErrorS(err, "unable to save sweeper state")
+	}
+
+	klog.V(4).InfoS("sweep() finished", "orphaned records", len(orphans), "deleted", deletions)
+	return orphans, nil
+}
+
+// seen returns when the orphaned record of the domain was first found, noting now if it
+// wasn't before
+func (s *recordSweeper) seen(domain, url string, now time.Time) time.Time {
+	s.Lock()
+	defer s.Unlock()
+	if first, ok := s.firstSeen[url]; ok {
+		return first.Time
+	}
+	s.firstSeen[url] = orphanSighting{Domain: domain, Time: now}
+	return now
+}
+
+// loadState adds the domains and first sightings kept in the state ConfigMap to those
+// known, i.e. after a restart or when another replica swept
+func (s *recordSweeper) loadState(ctx context.Context) error {
+	if s.stateConfigMap.Name == "" {
+		return nil
+	}
+	configMap, err := s.configMaps.CoreV1().ConfigMaps(s.stateConfigMap.Namespace).Get(ctx, s.stateConfigMap.Name, metav1.GetOptions{})
+	if apierrors.IsNotFound(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	state, err := decodeSweeperState(configMap)
+	if err != nil {
+		return err
+	}
+
+	s.Lock()
+	defer s.Unlock()
+	s.mergeDomains(state)
+	for url, seen := range state.FirstSeen {
+		if first, ok := s.firstSeen[url]; !ok || seen.Time.Before(first.Time) {
+			s.firstSeen[url] = seen
+		}
+	}
+	return nil
+}
+
+// saveState writes the domains and first sightings to the state ConfigMap, keeping the
+// domains added by other replicas meanwhile
+func (s *recordSweeper) saveState(ctx context.Context) error {
+	if s.stateConfigMap.Name == "" {
+		return nil
+	}
+	configMaps := s.configMaps.CoreV1().ConfigMaps(s.stateConfigMap.Namespace)
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		configMap, err := configMaps.Get(ctx, s.stateConfigMap.Name, metav1.GetOptions{})
+		notFound := apierrors.IsNotFound(err)
+		if err != nil && !notFound {
+			return err
+		}
+		if notFound {
+			configMap = &corev1.ConfigMap{ObjectMeta: metav1.ObjectMeta{Namespace: s.stateConfigMap.Namespace, Name: s.stateConfigMap.Name}}
+		} else if stored, err := decodeSweeperState(configMap); err == nil {
+			s.Lock()
+			s.mergeDomains(stored)
+			s.Unlock()
+		}
+
+		s.Lock()
+		state := sweeperState{FirstSeen: make(map[string]orphanSighting, len(s.firstSeen))}
+		for _, domain := range s.domains {
+			state.Domains = append(state.Domains, sweeperStateDomain{Name: domain.name, Namespace: domain.namespace, Config: domain.config})
+		}
+		for url, seen := range s.firstSeen {
+			state.FirstSeen[url] = seen
+		}
+		s.Unlock()
+		sort.Slice(state.Domains, func(i, j int) bool { return state.Domains[i].Name < state.Domains[j].Name })
+		data, err := json.Marshal(state)
+		if err != nil {
+			return err
+		}
+		configMap.Data = map[string]string{sweeperStateKey: string(data)}
+
+		if notFound {
+			_, err = configMaps.Create(ctx, configMap, metav1.CreateOptions{})
+		} else {
+			_, err = configMaps.Update(ctx, configMap, metav1.UpdateOptions{})
+		}
+		return err
+	})
+}
+
+// mergeDomains adds the stored domains not known yet - the caller holds the lock
+func (s *recordSweeper) mergeDomains(state sweeperState) {
+	for _, domain := range state.Domains {
+		if _, ok := s.domains[domain.Name]; !ok {
+			s.domains[domain.Name] = sweepDomain{name: domain.Name, config: domain.Config, namespace: domain.Namespace}
+		}
+	}
+}
+
+// decodeSweeperState reads the sweeper's state from its ConfigMap
+func decodeSweeperState(configMap *corev1.ConfigMap) (sweeperState, error) {
+	var state sweeperState
+	data, ok := configMap.Data[sweeperStateKey]
+	if !ok {
+		return state, nil
+	}
+	if err := json.Unmarshal([]byte(data), &state); err != nil {
+		return state, fmt.Errorf("invalid sweeper state in ConfigMap %s/%s: %v", configMap.Namespace, configMap.Name, err)
+	}
+	return state, nil
+}
+
+// isChallengeEntry reports whether the entry (relative to its domain) is the name of a
+// DNS-01 challenge record
+func isChallengeEntry(entry string) bool {
+	entry = strings.ToLower(entry)
+	return entry == challengeEntryPrefix || strings.HasPrefix(entry, challengeEntryPrefix+".")
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+// newTestSweeper creates a sweeper for the solver, with an existing Challenge using the
+// active key
+func newTestSweeper(t *testing.T, solver *customDNSProviderSolver, activeKey string) *recordSweeper {
+	challenges, _ := newTestChallengeStore(t, newChallengeObject("app", "active-challenge", "active-uid", activeKey))
+	return newRecordSweeper(solver, challenges, time.Hour, time.Hour, false, 1)
+}
+
+// backdate makes the orphaned records found so far old enough to be deleted
+func (s *recordSweeper) backdate() {
+	s.Lock()
+	defer s.Unlock()
+	for url, sighting := range s.firstSeen {
+		sighting.Time = time.Now().Add(-2 * s.minAge)
+		s.firstSeen[url] = sighting
+	}
+}
+
+// recordValues returns the values of the fake server's records
+func recordValues(fakeApi *fakevariomedia.Server) []string {
+	var values []string
+	for _, record := range fakeApi.Records() {
+		values = append(values, record.Data)
+	}
+	return values
+}
+
+func TestRecordSweeper_Sweep(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	for _, record := range []fakevariomedia.Record{
+		{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "stale-key", Ttl: 300},
+		{RecordType: "TXT", Name: "_acme-challenge.host", Domain: "example.com", Data: "other-stale-key", Ttl: 300},
+		{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "active-key", Ttl: 300},
+		{RecordType: "TXT", Name: "www", Domain: "example.com", Data: "not a challenge", Ttl: 300},
+		{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.org", Data: "key of unused domain", Ttl: 300},
+	} {
+		fakeApi.AddRecord(record)
+	}
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	var audit bytes.Buffer
+	solver.audit = newAuditLog("", auditSink{name: "buffer", Writer: &audit})
+	solver.sweeper = newTestSweeper(t, solver, "active-key")
+
+	// domains are swept once used by a challenge - the challenge's own record is kept
+	require.NoError(t, solver.Present(newTestChallenge("example.com.", "_acme-challenge.example.com.", "cached-key")))
+	audit.Reset()
+	previousHash := solver.audit.previousHash
+
+	// orphaned records are not deleted when first found
+	orphans, err := solver.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+	assert.Len(t, fakeApi.Records(), 6)
+
+	// ... but once they are old enough, up to the deletion limit
+	solver.sweeper.backdate()
+	orphans, err = solver.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	require.Len(t, orphans, 2)
+	assert.True(t, orphans[0].deleted)
+	assert.Equal(t, "_acme-challenge", orphans[0].entry)
+	assert.False(t, orphans[1].deleted)
+	assert.Equal(t, "_acme-challenge.host", orphans[1].entry)
+	assert.NotContains(t, recordValues(fakeApi), "stale-key")
+
+	orphans, err = solver.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	require.Len(t, orphans, 1)
+	assert.True(t, orphans[0].deleted)
+	assert.ElementsMatch(t, []string{"active-key", "not a challenge", "key of unused domain", "cached-key"}, recordValues(fakeApi))
+
+	// deletions are audited
+	events := readAuditEvents(t, audit.Bytes(), previousHash)
+	require.Len(t, events, 2)
+	for _, event := range events {
+		assert.Equal(t, auditSweep, event.Operation)
+		assert.Equal(t, "example.com", event.Domain)
+		assert.Empty(t, event.ChallengeUID)
+		assert.Equal(t, outcomeSuccess, event.Outcome)
+	}
+}
+
+func TestRecordSweeper_DryRun(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	fakeApi.AddRecord(fakevariomedia.Record{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "stale-key", Ttl: 300})
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	solver.sweeper = newTestSweeper(t, solver, "active-key")
+	solver.sweeper.dryRun = true
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	require.NoError(t, solver.Present(ch))
+	require.NoError(t, solver.CleanUp(ch))
+
+	_, err := solver.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	solver.sweeper.backdate()
+	orphans, err := solver.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	require.Len(t, orphans, 1)
+	assert.False(t, orphans[0].deleted)
+	assert.GreaterOrEqual(t, int64(orphans[0].age), int64(solver.sweeper.minAge))
+	assert.Equal(t, []string{"stale-key"}, recordValues(fakeApi))
+}
+
+func TestRecordSweeper_ListingFails(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	fakeApi.AddRecord(fakevariomedia.Record{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "stale-key", Ttl: 300})
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	solver.sweeper = newTestSweeper(t, solver, "active-key")
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	require.NoError(t, solver.Present(ch))
+	require.NoError(t, solver.CleanUp(ch))
+
+	_, err := solver.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	solver.sweeper.backdate()
+
+	// a domain that cannot be listed keeps the ages of its orphaned records ...
+	solver.apiBaseUrl = "http://127.0.0.1:1"
+	orphans, err := solver.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+	assert.Len(t, solver.sweeper.firstSeen, 1)
+
+	// ... so they are deleted once it can be listed again
+	solver.apiBaseUrl = fakeApi.URL()
+	orphans, err = solver.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	require.Len(t, orphans, 1)
+	assert.True(t, orphans[0].deleted)
+	assert.Empty(t, fakeApi.Records())
+}
+
+func TestRecordSweeperFromEnv(t *testing.T) {
+	t.Setenv(envSweepInterval, "")
+	sweeper, err := recordSweeperFromEnv(nil, nil, nil)
+	require.NoError(t, err)
+	assert.Nil(t, sweeper)
+
+	t.Setenv(envSweepInterval, "1h")
+	sweeper, err = recordSweeperFromEnv(nil, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, time.Hour, sweeper.interval)
+	assert.Equal(t, defaultSweepMinAge, sweeper.minAge)
+	assert.False(t, sweeper.dryRun)
+	assert.Equal(t, defaultSweepMaxDeletions, sweeper.maxDeletions)
+
+	t.Setenv(envSweepMinAge, "2h")
+	t.Setenv(envSweepDryRun, "true")
+	t.Setenv(envSweepMaxDeletions, "3")
+	sweeper, err = recordSweeperFromEnv(nil, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, 2*time.Hour, sweeper.minAge)
+	assert.True(t, sweeper.dryRun)
+	assert.Equal(t, 3, sweeper.maxDeletions)
+
+	t.Setenv(envSweepStateConfigMap, "cert-manager/variomedia-sweeper")
+	sweeper, err = recordSweeperFromEnv(nil, nil, nil)
+	require.NoError(t, err)
+	assert.Equal(t, types.NamespacedName{Namespace: "cert-manager", Name: "variomedia-sweeper"}, sweeper.stateConfigMap)
+
+	t.Setenv(envSweepStateConfigMap, "variomedia-sweeper")
+	_, err = recordSweeperFromEnv(nil, nil, nil)
+	assert.Error(t, err)
+
+	t.Setenv(envSweepStateConfigMap, "")
+	t.Setenv(envSweepDryRun, "maybe")
+	_, err = recordSweeperFromEnv(nil, nil, nil)
+	assert.Error(t, err)
+}
+
+func TestRecordSweeper_State(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	fakeApi.AddRecord(fakevariomedia.Record{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "stale-key", Ttl: 300})
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	state := types.NamespacedName{Namespace: "cert-manager", Name: "variomedia-sweeper"}
+	solver.sweeper = newTestSweeper(t, solver, "active-key")
+	solver.sweeper.configMaps, solver.sweeper.stateConfigMap = solver.client, state
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	require.NoError(t, solver.Present(ch))
+	require.NoError(t, solver.CleanUp(ch))
+
+	// the orphaned record is found, but not old enough yet
+	orphans, err := solver.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	assert.Empty(t, orphans)
+	solver.sweeper.backdate()
+	require.NoError(t, solver.sweeper.saveState(context.Background()))
+	configMap, err := solver.client.CoreV1().ConfigMaps(state.Namespace).Get(context.Background(), state.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	assert.Contains(t, configMap.Data[sweeperStateKey], `"name":"example.com"`)
+	assert.NotContains(t, configMap.Data[sweeperStateKey], "fake-api-token")
+
+	// after a restart, the domain is still swept and the record's age is kept
+	restarted := newTestSolver(fakeApi, "fake-api-token")
+	restarted.client = solver.client
+	restarted.sweeper = newTestSweeper(t, restarted, "active-key")
+	restarted.sweeper.configMaps, restarted.sweeper.stateConfigMap = restarted.client, state
+	orphans, err = restarted.sweeper.sweep(context.Background())
+	require.NoError(t, err)
+	require.Len(t, orphans, 1)
+	assert.True(t, orphans[0].deleted)
+	assert.Empty(t, fakeApi.Records())
+
+	// forgotten records are dropped from the state
+	configMap, err = solver.client.CoreV1().ConfigMaps(state.Namespace).Get(context.Background(), state.Name, metav1.GetOptions{})
+	require.NoError(t, err)
+	stored, err := decodeSweeperState(configMap)
+	require.NoError(t, err)
+	assert.Empty(t, stored.FirstSeen)
+	assert.Len(t, stored.Domains, 1)
+}
+
+func TestIsChallengeEntry(t *testing.T) {
+	assert.True(t, isChallengeEntry("_acme-challenge"))
+	assert.True(t, isChallengeEntry("_ACME-Challenge.host"))
+	assert.False(t, isChallengeEntry("www"))
+	assert.False(t, isChallengeEntry("_acme-challenge-backup"))
+	assert.False(t, isChallengeEntry(""))
+}
@@ -0,0 +1,116 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// OpenTelemetry tracing of challenges and Variomedia API calls
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/url"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp"
+	"go.opentelemetry.io/otel/exporters/otlp/otlphttp"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"k8s.io/klog/v2"
+)
+
+const (
+	// instrumentation name of the webhook's spans
+	tracerName = "github.com/jmozd/cert-manager-webhook-variomedia"
+	// service name reported to the collector
+	tracingServiceName = "cert-manager-webhook-variomedia"
+	// time given to export pending spans when the webhook stops
+	tracingShutdownTimeout = 5 * time.Second
+)
+
+// span attributes
+const (
+	attrFqdn        = attribute.Key("variomedia.fqdn")
+	attrZone        = attribute.Key("variomedia.zone")
+	attrDomain      = attribute.Key("variomedia.domain")
+	attrEntry       = attribute.Key("variomedia.entry")
+	attrSecret      = attribute.Key("variomedia.secret")
+	attrJobId       = attribute.Key("variomedia.job.id")
+	attrJobStatus   = attribute.Key("variomedia.job.status")
+	attrJobLookup   = attribute.Key("variomedia.job.lookup")
+	attrRetries     = attribute.Key("variomedia.retries")
+	attrHttpMethod  = attribute.Key("http.method")
+	attrHttpUrl     = attribute.Key("http.url")
+	attrHttpStatus  = attribute.Key("http.status_code")
+	attrServiceName = attribute.Key("service.name")
+)
+
+// startSpan starts a span as child of the span in the context, if any. The tracer is
+// looked up each time, so spans go to whichever provider is currently set up - without
+// one, spans are no-ops.
+func startSpan(ctx context.Context, name string, attributes ...attribute.KeyValue) (context.Context, trace.Span) {
+	return otel.Tracer(tracerName).Start(ctx, name, trace.WithAttributes(attributes...))
+}
+
+// endSpan ends the span, marking it as failed if there was an error
+func endSpan(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+	span.End()
+}
+
+// setupTracing exports all spans via OTLP/HTTP to the collector at the endpoint
+// (i.e. "http://otel-collector:4318") until stopCh is closed, and propagates the trace
+// context to the Variomedia API
+func setupTracing(endpoint string, stopCh <-chan struct{}) error {
+	klog.V(4).InfoS("setupTracing() called")
+	klog.V(5).InfoS("parameters", "endpoint", endpoint)
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Host == "" || (u.Scheme != "http" && u.Scheme != "https") {
+		err = fmt.Errorf("invalid OTLP endpoint '%s' in %s, expected i.e. 'http://otel-collector:4318'", endpoint, envOtlpEndpoint)
+		klog.ErrorS(err, "setupTracing() finished with error")
+		return err
+	}
+	opts := []otlphttp.Option{otlphttp.WithEndpoint(u.Host)}
+	if u.Scheme == "http" {
+		opts = append(opts, otlphttp.WithInsecure())
+	}
+
+	ctx := context.Background()
+	exporter, err := otlp.NewExporter(ctx, otlphttp.NewDriver(opts...))
+	if err != nil {
+		klog.ErrorS(err, "setupTracing() finished with error while creating the OTLP exporter")
+		return err
+	}
+	res, err := resource.New(ctx, resource.WithAttributes(attrServiceName.String(tracingServiceName)))
+	if err != nil {
+		klog.ErrorS(err, "setupTracing() finished with error while creating the resource")
+		return err
+	}
+
+	provider := sdktrace.NewTracerProvider(sdktrace.WithBatcher(exporter), sdktrace.WithResource(res))
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(propagation.TraceContext{}, propagation.Baggage{}))
+
+	// pending spans are exported when the webhook stops
+	go func() {
+		<-stopCh
+		ctx, cancel := context.WithTimeout(context.Background(), tracingShutdownTimeout)
+		defer cancel()
+		if err := provider.Shutdown(ctx); err != nil {
+			klog.ErrorS(err, "unable to export pending spans")
+		}
+	}()
+
+	klog.V(2).InfoS("exporting traces", "endpoint", endpoint)
+	klog.V(4).InfoS("setupTracing() finished")
+	return nil
+}
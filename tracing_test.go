@@ -0,0 +1,124 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.opentelemetry.io/otel/trace"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+// fakeCollector receives the spans exported via OTLP/HTTP. The spans are kept as sent
+// (protobuf), which holds names and attribute values as plain strings.
+type fakeCollector struct {
+	sync.Mutex
+	exports [][]byte
+}
+
+func (f *fakeCollector) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	body, _ := ioutil.ReadAll(r.Body)
+	if r.URL.Path == "/v1/traces" {
+		f.Lock()
+		f.exports = append(f.exports, body)
+		f.Unlock()
+	}
+	w.Header().Set("Content-Type", "application/x-protobuf")
+	w.WriteHeader(http.StatusOK)
+}
+
+func (f *fakeCollector) received(s string) bool {
+	f.Lock()
+	defer f.Unlock()
+	for _, export := range f.exports {
+		if bytes.Contains(export, []byte(s)) {
+			return true
+		}
+	}
+	return false
+}
+
+// headerRecorder records the headers of all requests it passes on
+type headerRecorder struct {
+	sync.Mutex
+	headers []http.Header
+}
+
+func (h *headerRecorder) RoundTrip(req *http.Request) (*http.Response, error) {
+	h.Lock()
+	h.headers = append(h.headers, req.Header.Clone())
+	h.Unlock()
+	return http.DefaultTransport.RoundTrip(req)
+}
+
+func TestSetupTracing(t *testing.T) {
+	collector := &fakeCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	defer func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	assert.Error(t, setupTracing("otel-collector:4318", nil), "endpoint without scheme")
+
+	stopCh := make(chan struct{})
+	require.NoError(t, setupTracing(server.URL, stopCh))
+
+	fakeApi := fakevariomedia.NewTest(t, "fake-api-token")
+	solver := newTestSolver(fakeApi, "fake-api-token")
+	recorder := &headerRecorder{}
+	solver.httpClient = &http.Client{Transport: recorder}
+
+	ch := newTestChallenge("example.com.", "_acme-challenge.example.com.", "challenge-key")
+	require.NoError(t, solver.Present(ch))
+	require.NoError(t, solver.CleanUp(ch))
+
+	// the trace context is passed on to Variomedia
+	require.NotEmpty(t, recorder.headers)
+	for _, header := range recorder.headers {
+		assert.NotEmpty(t, header.Get("traceparent"))
+	}
+
+	// pending spans are exported on shutdown
+	close(stopCh)
+	for _, s := range []string{"Present", "CleanUp", "loadApiKey", "HTTP POST", "HTTP DELETE", "example.com", "_acme-challenge", tracingServiceName} {
+		assert.Eventually(t, func() bool { return collector.received(s) }, 5*time.Second, 10*time.Millisecond, "%q not exported", s)
+	}
+}
+
+func TestVariomediaJobWaiter_TracesPolls(t *testing.T) {
+	fakeApi := fakevariomedia.NewTest(t, "key")
+	fakeApi.PendingPolls = 2
+	defer func() {
+		otel.SetTracerProvider(trace.NewNoopTracerProvider())
+		otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator())
+	}()
+
+	collector := &fakeCollector{}
+	server := httptest.NewServer(collector)
+	defer server.Close()
+	stopCh := make(chan struct{})
+	require.NoError(t, setupTracing(server.URL, stopCh))
+
+	waiter := variomediaJobWaiter{InitialDelay: time.Millisecond, MaxDelay: time.Millisecond}
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(fakeApi.URL()), WithJobWaiter(waiter))
+	domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+	_, err := client.UpdateTxtRecord(context.Background(), &domain, &name, &value, variomediaMinTtl)
+	require.NoError(t, err)
+
+	close(stopCh)
+	for _, s := range []string{"poll DNS job", string(attrJobStatus), "pending", "done"} {
+		assert.Eventually(t, func() bool { return collector.received(s) }, 5*time.Second, 10*time.Millisecond, "%q not exported", s)
+	}
+}
@@ -5,17 +5,20 @@
 // Licensed under LGPL v3
 //
 // Entry points:
-// client = NewvariomediaClient( apikey)
+// client = NewvariomediaClient( apikey, options...)
 //	- create new instance of API client
 //	in:
 //		apikey	-	customer-specific API key issued by Variomedia
+//		options	-	optional settings, i.e. WithBaseUrl(), WithHttpClient(), WithTimeout(), WithJobWaiter(),
+//				WithRateLimiter(), WithEventHandler()
 //	returns:
 //		client object
 //
 //
-// client.UpdateTxtRecord(&domain, &entry, Key, ttl)
+// client.UpdateTxtRecord(ctx, &domain, &entry, Key, ttl)
 //	- update TXT record
 //	in:
+//		ctx	-	context to cancel the request and waiting for its job
 //		domain	-	DNS domain
 //		entry	-	host label
 //		key	-	valus of TXT record
@@ -23,11 +26,44 @@
 //	returns:
 //		variomediaDNSEntryURL   -       the URL of the resulting DNS entry
 //
-// client.DeleteTxtRecord(&domain, &entry)
+// client.DeleteTxtRecord(ctx, url)
 //	- delete TXT record for entry/domain
 //	in:
+//		ctx	-	context to cancel the request and waiting for its job
 //		url     -       DNS entry's URL
-//		ttl     -       TTL of record
+//	returns:
+//		-
+//
+// client.FindTxtRecord(ctx, &domain, &entry, &key)
+//	- look up the URL of an existing TXT record
+//	in:
+//		ctx	-	context to cancel the request
+//		domain	-	DNS domain
+//		entry	-	host label
+//		key	-	value of TXT record
+//	returns:
+//		variomediaDNSEntryURL   -       the URL of the matching DNS entry, empty if none
+//
+// client.ListTxtRecords(ctx, &domain)
+//	- list all TXT records of a domain
+//	in:
+//		ctx	-	context to cancel the requests
+//		domain	-	DNS domain
+//	returns:
+//		records	-	the domain's TXT records
+//
+// client.CheckApiKey(ctx, &domain)
+//	- check that Variomedia accepts the API key
+//	in:
+//		ctx	-	context to cancel the request
+//		domain	-	DNS domain the key is used for
+//	returns:
+//		-
+//
+// client.Ping(ctx)
+//	- check that the API endpoint answers
+//	in:
+//		ctx	-	context to cancel the request
 //	returns:
 //		-
 
@@ -35,24 +71,58 @@ package main
 
 import (
 	"bytes"
+	"context"
 	"encoding/json"
 	"fmt"
 	"io/ioutil"
 	"net/http"
+	"net/url"
+	"strings"
 	"time"
 
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/propagation"
+	"golang.org/x/time/rate"
 	"k8s.io/klog/v2"
 )
 
 const (
-	variomediaLiveDnsBaseUrl = "https://api.variomedia.de/dns-records"
-	statusLookupDelay = 2 * time.Second
+	variomediaLiveApiBaseUrl = "https://api.variomedia.de"
+	variomediaDefaultTimeout = 30 * time.Second
+	// upper limit of pages followed when listing DNS records
+	variomediaMaxRecordListPages = 100
 )
 
 type variomediaClient struct {
-	apiKey              string
+	apiKey              variomediaApiKey
+	baseUrl             string
+	httpClient          *http.Client
+	jobWaiter           variomediaJobWaiter
+	rateLimiter         *rate.Limiter
+	// ID of the DNS job started by the most recent change, if any - for the audit log
+	lastJobId           string
+	// told about noteworthy progress, i.e. to record it as Kubernetes event - may be nil
+	eventHandler        variomediaEventHandler
 }
 
+// variomediaClientEvent is noteworthy progress of the client's requests
+type variomediaClientEvent int
+
+const (
+	// a rate-limited request is retried
+	variomediaEventRateLimited variomediaClientEvent = iota
+	// a DNS job is still pending
+	variomediaEventJobPending
+)
+
+// variomediaEventHandler is told about noteworthy progress of the client's requests, with
+// a message describing it
+type variomediaEventHandler func(event variomediaClientEvent, message string)
+
+// variomediaClientOption is used to adjust the client settings at creation time
+type variomediaClientOption func(*variomediaClient)
+
 type variomediaDnsAttributes struct {
 	RecordType	string	`json:"record_type"`
 	Name		string	`json:"name"`
@@ -70,10 +140,31 @@ type variomediaRequest struct {
 	variomediaData `json:"data"`
 } // variomediaRequest
 
+// variomediaAttributes holds the attributes of a JSON:API resource. Values other than
+// strings (i.e. a record's TTL) are kept in their JSON representation.
+type variomediaAttributes map[string]string
+
+func (a *variomediaAttributes) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	*a = make(variomediaAttributes, len(raw))
+	for key, value := range raw {
+		var str string
+		if err := json.Unmarshal(value, &str); err == nil {
+			(*a)[key] = str
+		} else {
+			(*a)[key] = string(value)
+		}
+	}
+	return nil
+}
+
 type variomediaJobData struct {
 	Type	string `json:"type"`
 	Id	string `json:"id"`
-	Attributes	map[string]string `json:"attributes"`
+	Attributes	variomediaAttributes `json:"attributes"`
 	Links	map[string]string `json:"links"`
 } // variomediaJobData
 
@@ -82,28 +173,116 @@ type variomediaResponse struct {
 	Links map[string]string `json:"links"`
 } // variomediaRequest
 
+type variomediaDnsRecord struct {
+	Type	string `json:"type"`
+	Id	string `json:"id"`
+	Attributes	variomediaDnsAttributes `json:"attributes"`
+	Links	map[string]string `json:"links"`
+} // variomediaDnsRecord
+
+type variomediaDnsRecordList struct {
+	Data	[]variomediaDnsRecord `json:"data"`
+	Links	map[string]string `json:"links"`
+} // variomediaDnsRecordList
+
+// WithBaseUrl()
+// talk to the Variomedia API at the given endpoint (i.e. a local stand-in) instead of the live API
+func WithBaseUrl(baseUrl string) variomediaClientOption {
+	return func(c *variomediaClient) {
+		if baseUrl != "" {
+			c.baseUrl = strings.TrimSuffix(baseUrl, "/")
+		}
+	}
+}
+
+// WithHttpClient()
+// use the given HTTP client (and thus its transport) for all requests
+func WithHttpClient(httpClient *http.Client) variomediaClientOption {
+	return func(c *variomediaClient) {
+		if httpClient != nil {
+			c.httpClient = httpClient
+		}
+	}
+}
+
+// WithTimeout()
+// limit the duration of each single HTTP request. As the HTTP client may be shared,
+// the timeout is set on a copy of it.
+func WithTimeout(timeout time.Duration) variomediaClientOption {
+	return func(c *variomediaClient) {
+		if timeout > 0 {
+			httpClient := *c.httpClient
+			httpClient.Timeout = timeout
+			c.httpClient = &httpClient
+		}
+	}
+}
+
+// WithJobWaiter()
+// wait for Variomedia's DNS jobs using the given backoff and deadline settings
+func WithJobWaiter(jobWaiter variomediaJobWaiter) variomediaClientOption {
+	return func(c *variomediaClient) {
+		c.jobWaiter = jobWaiter
+	}
+}
+
+// WithRateLimiter()
+// pass all requests through the given token bucket, which should be shared by all
+// clients using the same API key
+func WithRateLimiter(rateLimiter *rate.Limiter) variomediaClientOption {
+	return func(c *variomediaClient) {
+		c.rateLimiter = rateLimiter
+	}
+}
+
+// WithEventHandler()
+// tell the handler about noteworthy progress, i.e. pending DNS jobs and hitting the rate limit
+func WithEventHandler(eventHandler variomediaEventHandler) variomediaClientOption {
+	return func(c *variomediaClient) {
+		c.eventHandler = eventHandler
+	}
+}
+
+// client.event()
+// pass an event to the event handler, if there is one
+func (c *variomediaClient) event(event variomediaClientEvent, message string) {
+	if c.eventHandler != nil {
+		c.eventHandler(event, message)
+	}
+}
+
 // NewvariomediaClient()
 // create new instance of Variomedia client
-func NewvariomediaClient(apiKey string) *variomediaClient {
+func NewvariomediaClient(apiKey variomediaApiKey, opts ...variomediaClientOption) *variomediaClient {
 	klog.V(4).InfoS("NewvariomediaClient() called")
 	klog.V(5).InfoS("parameters", "API key", apiKey)
 
-	klog.V(4).InfoS("NewvariomediaClient() finished")
-	return &variomediaClient{
+	c := &variomediaClient{
 		apiKey:              apiKey,
+		baseUrl:             variomediaLiveApiBaseUrl,
+		httpClient:          &http.Client{ Timeout: variomediaDefaultTimeout},
+		jobWaiter:           defaultJobWaiter(),
 	}
+	for _, opt := range opts {
+		opt(c)
+	}
+
+	klog.V(4).InfoS("NewvariomediaClient() finished")
+	klog.V(5).InfoS("return values", "base URL", c.baseUrl)
+	return c
 }
 
-// client.UpdateTxtRecord(&domain, &entry, Key, ttl)
+// client.UpdateTxtRecord(ctx, &domain, &entry, Key, ttl)
 //	- create or update TXT record
 //	in:
+//		ctx	-	context to cancel the request and waiting for its job
 //		domain	-	DNS domain
 //		entry	-	host label
 //		key	-	valus of TXT record
 //		ttl	-	TTL of record
 //	returns:
 //		variomediaDNSEntryURL	-	the URL of the resulting DNS entry
-func (c *variomediaClient) UpdateTxtRecord(domain *string, name *string, value *string, ttl int) (string, error) {
+func (c *variomediaClient) UpdateTxtRecord(ctx context.Context, domain *string, name *string, value *string, ttl int) (string, error) {
 	klog.V(4).InfoS("UpdateTxtRecord() called")
 	klog.V(5).InfoS("parameters", "domain", *domain, "name", *name, "value", *value, "TTL", ttl)
 
@@ -128,260 +307,460 @@ func (c *variomediaClient) UpdateTxtRecord(domain *string, name *string, value *
 		return "", fmt.Errorf("cannot marshall to json: %v", err)
 	}
 
-	req, err := http.NewRequest("POST", variomediaLiveDnsBaseUrl, bytes.NewReader(body))
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseUrl + "/dns-records", bytes.NewReader(body))
 	if err != nil {
 		klog.ErrorS(err, "UpdateTxtRecord() finished with error")
 		return "", err
 	}
 
 	// contact Variomedia and check the results
-	status, respData, err := c.doRequest(req, true)
+	status, header, respData, err := c.doRequest(req, true)
 	if err != nil {
 		klog.ErrorS(err, "UpdateTxtRecord() finished with error")
 		return "", err
 	}
 
-	// have we hit the rate limit?
-	if status == http.StatusTooManyRequests {
-		klog.ErrorS( nil, "UpdateTxtRecord() finished with errori 'too many requests' reported by Variomedia")
-		return "", fmt.Errorf("Variomedia rate limit reached (HTTP code %d)", http.StatusTooManyRequests)
-	}
-
 	if status != http.StatusCreated && status != http.StatusOK && status != http.StatusAccepted {
-		klog.ErrorS(nil, "UpdateTxtRecord() finished with error reported by server", "status code", status)
-		return "", fmt.Errorf("failed creating TXT record: server reported status code %d", status)
+		apiErr := newVariomediaApiError(status, respData)
+		klog.ErrorS(apiErr, "UpdateTxtRecord() finished with error reported by server", "status code", status)
+		return "", fmt.Errorf("failed creating TXT record: %w", apiErr)
 	}
 
+	// a "201 Created" points to the new record via the Location header, maybe without a body -
+	// other replies may do so as well, where their body doesn't link the record
+	location := resolveLocation(req, header.Get("Location"))
+
 	// the request has succeeded - but is the job already finished?
 	// check the response for an according '' element
 	var reply variomediaResponse
-	err = json.Unmarshal( respData, &reply)
-	if err != nil {
-		klog.ErrorS(err, "UpdateTxtRecord() finished with error")
-		return "", fmt.Errorf("cannot unmarshall response to json: %v", err)
+	if len(bytes.TrimSpace(respData)) > 0 {
+		err = json.Unmarshal( respData, &reply)
+		if err != nil {
+			klog.ErrorS(err, "UpdateTxtRecord() finished with error")
+			return "", fmt.Errorf("cannot unmarshall response to json: %v", err)
+		}
+		klog.V(5).InfoS( "HTTP finished", "JSON reply", reply)
 	}
-	klog.V(5).InfoS( "HTTP finished", "JSON reply", reply)
-
-	// we give it 5 iterations to finish
-	loopcount := 5
-	for {
-		if reply.Data.Attributes[ "status"] == "pending" {
-			klog.V(2).InfoS( "DNS job still pending")
-
-			// inter-loop delay
-			time.Sleep( statusLookupDelay)
-
-			// re-fetch the job status
-			req, err := http.NewRequest("GET", reply.Data.Links[ "queue-job"], nil)
-			if err != nil {
-				klog.ErrorS(err, "UpdateTxtRecord() finished with error")
-				return "", err
-			}
-
-			// contact Variomedia and check the results
-			status, respData, err := c.doRequest(req, true)
-			if err != nil {
-				klog.ErrorS(err, "UpdateTxtRecord() finished with error")
-				return "", err
-			}
-
-			// have we hit the rate limit?
-			if status == http.StatusTooManyRequests {
-				klog.ErrorS( nil, "UpdateTxtRecord() finished with errori 'too many requests' reported by Variomedia")
-				return "", fmt.Errorf("Variomedia rate limit reached (HTTP code %d)", http.StatusTooManyRequests)
-			}
-
-			if status != http.StatusCreated && status != http.StatusOK && status != http.StatusAccepted {
-				klog.ErrorS(nil, "UpdateTxtRecord() finished with error reported by server", "status code", status)
-				return "", fmt.Errorf("failed creating TXT record: server reported status code %d", status)
-			}
-
-			// the request has succeeded - but is the job already finished?
-			// check the response for an according '' element
-			err = json.Unmarshal( respData, &reply)
-			if err != nil {
-				klog.ErrorS(err, "UpdateTxtRecord() finished with error")
-				return "", fmt.Errorf("cannot unmarshall response to json: %v", err)
-			}
-			klog.V(5).InfoS( "HTTP finished", "JSON reply", reply)
 
+	if isVariomediaJob(reply) {
+		c.lastJobId = reply.Data.Id
+		reply, err = c.jobWaiter.wait( ctx, c, reply, "creating TXT record", false)
+		if err != nil {
+			klog.ErrorS(err, "UpdateTxtRecord() finished with error")
+			return "", err
 		}
-		loopcount -= 1
+	}
 
-		if (reply.Data.Attributes[ "status"] == "done") {
-			klog.V(2).InfoS( "DNS job finished", "retries left", loopcount)
-			break;
-		}
-		if (loopcount == 0) {
-			klog.ErrorS(nil, "UpdateTxtRecord() finished with error: job timed out", "most recent status", reply.Data.Attributes[ "status"])
-			return "", fmt.Errorf("DNS update job timed out with most recent status '%s'", reply.Data.Attributes[ "status"])
-		}
-	} // emulated do until
+	recordUrl := c.recordUrl(reply, location)
+	if recordUrl == "" {
+		klog.ErrorS(nil, "UpdateTxtRecord() finished with error: no record URL in response", "status code", status)
+		return "", fmt.Errorf("failed creating TXT record: Variomedia's response (HTTP status %d) contains no record URL", status)
+	}
 
 	klog.V(4).InfoS("UpdateTxtRecord() finished")
-	klog.V(5).InfoS("return values", "url", reply.Data.Links[ "dns-record"])
-	return reply.Data.Links[ "dns-record"], nil
+	klog.V(5).InfoS("return values", "url", recordUrl)
+	return recordUrl, nil
 } //func UpdateTxtRecord()
 
-// client.DeleteTxtRecord(&domain, &entry, Key, ttl)
-//	- create or update TXT record
+// client.DeleteTxtRecord(ctx, url)
+//	- delete TXT record
 //	in:
+//		ctx	-	context to cancel the request and waiting for its job
 //		url	-	DNS entry's URL
-//		ttl	-	TTL of record
 //	returns:
 //		-
-func (c *variomediaClient) DeleteTxtRecord(url string, ttl int) error {
+func (c *variomediaClient) DeleteTxtRecord(ctx context.Context, url string) error {
 	klog.V(4).InfoS("DeleteTxtRecord() called")
-	klog.V(5).InfoS("parameters", "url", url, "TTL", ttl)
+	klog.V(5).InfoS("parameters", "url", url)
 
 	// deleting a record happens by sending a HTTP "DELETE" request to the DNS entry's URL
-	req, err := http.NewRequest("DELETE", url, nil)
+	req, err := http.NewRequestWithContext(ctx, "DELETE", url, nil)
 	if err != nil {
 		klog.ErrorS(err, "DeleteTxtRecord() finished with error")
 		return err
 	}
 
 	// contact Variomedia and check the results
-	status, respData, err := c.doRequest(req, true)
+	status, _, respData, err := c.doRequest(req, true)
 	if err != nil {
 		klog.ErrorS(err, "DeleteTxtRecord() finished with error")
 		return err
 	}
 
-	// have we hit the rate limit?
-	if status == http.StatusTooManyRequests {
-		klog.ErrorS( nil, "DeleteTxtRecord() finished with errori 'too many requests' reported by Variomedia")
-		return fmt.Errorf("Variomedia rate limit reached (HTTP code %d)", http.StatusTooManyRequests)
+	// 404 means "DNS record not found" - we're fine with that, the record is gone
+	if status == http.StatusNotFound {
+		klog.V(4).InfoS("DeleteTxtRecord() finished because DNS record is gone")
+		return nil
 	}
 
-	if status != http.StatusCreated && status != http.StatusOK && status != http.StatusAccepted {
-		klog.ErrorS(nil, "DeleteTxtRecord() finished with error reported by server", "status code", status)
-		return fmt.Errorf("failed deleting TXT record: %v", err)
+	if status != http.StatusCreated && status != http.StatusOK && status != http.StatusAccepted && status != http.StatusNoContent {
+		apiErr := newVariomediaApiError(status, respData)
+		klog.ErrorS(apiErr, "DeleteTxtRecord() finished with error reported by server", "status code", status)
+		return fmt.Errorf("failed deleting TXT record: %w", apiErr)
 	}
 
 	// the request has succeeded - but is the job already finished?
 	// check the response for an according '' element
 	var reply variomediaResponse
-	err = json.Unmarshal( respData, &reply)
+	if len(bytes.TrimSpace(respData)) > 0 {
+		err = json.Unmarshal( respData, &reply)
+		if err != nil {
+			klog.ErrorS(err, "DeleteTxtRecord() finished with error")
+			return fmt.Errorf("cannot unmarshall response to json: %v", err)
+		}
+		klog.V(5).InfoS( "HTTP finished", "JSON reply", reply)
+	}
+
+	// without a job, the record is deleted right away
+	if !isVariomediaJob(reply) {
+		klog.V(4).InfoS("DeleteTxtRecord() finished without DNS job", "status code", status)
+		return nil
+	}
+
+	// a job that is gone before it's reported "done" means the record is gone, too
+	c.lastJobId = reply.Data.Id
+	_, err = c.jobWaiter.wait( ctx, c, reply, "deleting TXT record", true)
 	if err != nil {
 		klog.ErrorS(err, "DeleteTxtRecord() finished with error")
-		return fmt.Errorf("cannot unmarshall response to json: %v", err)
+		return err
 	}
-	klog.V(5).InfoS( "HTTP finished", "JSON reply", reply)
-
-	// we give it 5 iterations to finish
-	loopcount := 5
-	for {
-		if reply.Data.Attributes[ "status"] == "pending" && status != http.StatusNotFound {
-			klog.V(2).InfoS( "DNS job still pending")
 
-			// inter-loop delay: two seconds
-			time.Sleep( statusLookupDelay)
+	klog.V(4).InfoS("DeleteTxtRecord() finished")
+	return nil
+} // func DeleteTxtRecord()
 
-			// re-fetch the job status
-			req, err := http.NewRequest("GET", reply.Data.Links[ "queue-job"], nil)
-			if err != nil {
-				klog.ErrorS(err, "DeleteTxtRecord() finished with error")
-				return err
-			}
+// client.FindTxtRecord(ctx, &domain, &entry, &key)
+//	- look up an existing TXT record via Variomedia's record listing
+//	in:
+//		ctx	-	context to cancel the request
+//		domain	-	DNS domain
+//		entry	-	host label
+//		key	-	value of TXT record
+//	returns:
+//		variomediaDNSEntryURL	-	the URL of the matching DNS entry, empty if none exists
+func (c *variomediaClient) FindTxtRecord(ctx context.Context, domain *string, name *string, value *string) (string, error) {
+	klog.V(4).InfoS("FindTxtRecord() called")
+	klog.V(5).InfoS("parameters", "domain", *domain, "name", *name, "value", *value)
 
-			// contact Variomedia and check the results
-			status, respData, err := c.doRequest(req, true)
-			if err != nil {
-				klog.ErrorS(err, "DeleteTxtRecord() finished with error")
-				return err
-			}
+	records, err := c.ListTxtRecords(ctx, domain)
+	if err != nil {
+		klog.ErrorS(err, "FindTxtRecord() finished with error")
+		return "", err
+	}
 
-			// have we hit the rate limit?
-			if status == http.StatusTooManyRequests {
-				klog.ErrorS( nil, "DeleteTxtRecord() finished with errori 'too many requests' reported by Variomedia")
-				return fmt.Errorf("Variomedia rate limit reached (HTTP code %d)", http.StatusTooManyRequests)
-			}
+	for _, record := range records {
+		attr := record.Attributes
+		if !strings.EqualFold( attr.Name, *name) || attr.Data != *value {
+			continue
+		}
 
-			if status != http.StatusCreated && status != http.StatusOK && status != http.StatusAccepted && status != http.StatusNotFound {
-				klog.ErrorS(nil, "DeleteTxtRecord() finished with error reported by server", "status code", status)
-				return fmt.Errorf("failed creating TXT record: %v", err)
-			}
+		recordUrl := c.listedRecordUrl( record)
+		klog.V(4).InfoS("FindTxtRecord() finished")
+		klog.V(5).InfoS("return values", "url", recordUrl)
+		return recordUrl, nil
+	}
 
-			// the request has succeeded - but is the job already finished?
-			// check the response for an according '' element
-			err = json.Unmarshal( respData, &reply)
-			if err != nil {
-				klog.ErrorS(err, "DeleteTxtRecord() finished with error")
-				return fmt.Errorf("cannot unmarshall response to json: %v", err)
-			}
-			klog.V(5).InfoS( "HTTP finished", "JSON reply", reply)
+	klog.V(4).InfoS("FindTxtRecord() finished without match")
+	return "", nil
+} // func FindTxtRecord()
 
+// client.ListTxtRecords(ctx, &domain)
+//	- list all TXT records of a domain via Variomedia's record listing
+//	in:
+//		ctx	-	context to cancel the requests
+//		domain	-	DNS domain
+//	returns:
+//		records	-	the domain's TXT records, use client.listedRecordUrl() for their URLs
+func (c *variomediaClient) ListTxtRecords(ctx context.Context, domain *string) ([]variomediaDnsRecord, error) {
+	klog.V(4).InfoS("ListTxtRecords() called")
+	klog.V(5).InfoS("parameters", "domain", *domain)
+
+	// the listing is paginated - we follow the "next" links until we run out of pages
+	var records []variomediaDnsRecord
+	listUrl := c.variomediaRecordsUrl( *domain)
+	visited := make(map[string]bool)
+	for listUrl != "" {
+		if err := visitRecordListPage(visited, listUrl); err != nil {
+			klog.ErrorS(err, "ListTxtRecords() finished with error")
+			return nil, err
+		}
+		req, err := http.NewRequestWithContext(ctx, "GET", listUrl, nil)
+		if err != nil {
+			klog.ErrorS(err, "ListTxtRecords() finished with error")
+			return nil, err
 		}
 
-		// 404 means "DNS record not found" (anymore) - we're fine with that, the record is gone
-		if status == http.StatusNotFound {
-			klog.V(4).InfoS("DeleteTxtRecord() finished because DNS record is gone", "retries left", loopcount)
-			return nil
+		// contact Variomedia and check the results
+		status, _, respData, err := c.doRequest(req, true)
+		if err != nil {
+			klog.ErrorS(err, "ListTxtRecords() finished with error")
+			return nil, err
 		}
 
-		loopcount -= 1
+		if status != http.StatusOK {
+			apiErr := newVariomediaApiError(status, respData)
+			klog.ErrorS(apiErr, "ListTxtRecords() finished with error reported by server", "status code", status)
+			return nil, fmt.Errorf("failed listing DNS records: %w", apiErr)
+		}
 
-		if (reply.Data.Attributes[ "status"] == "done") {
-			klog.V(2).InfoS( "DNS job finished", "retries left", loopcount)
-			break;
+		var reply variomediaDnsRecordList
+		err = json.Unmarshal( respData, &reply)
+		if err != nil {
+			klog.ErrorS(err, "ListTxtRecords() finished with error")
+			return nil, fmt.Errorf("cannot unmarshall response to json: %v", err)
 		}
-		if (loopcount == 0) {
-			klog.ErrorS(nil, "DeleteTxtRecord() finished with error: job timed out", "most recent status", reply.Data.Attributes[ "status"])
-			return fmt.Errorf("DNS update job timed out with most recent status '%s'", reply.Data.Attributes[ "status"])
+		klog.V(5).InfoS( "HTTP finished", "JSON reply", reply)
+
+		for _, record := range reply.Data {
+			attr := record.Attributes
+			// Variomedia filters by domain already, but we don't want to rely on that
+			if attr.RecordType != "TXT" || (attr.Domain != "" && !strings.EqualFold( attr.Domain, *domain)) {
+				continue
+			}
+			records = append(records, record)
 		}
-	} // emulated do until
 
-	klog.V(4).InfoS("DeleteTxtRecord() finished")
+		listUrl = reply.Links[ "next"]
+	}
+
+	klog.V(4).InfoS("ListTxtRecords() finished")
+	klog.V(5).InfoS("return values", "records", len(records))
+	return records, nil
+} // func ListTxtRecords()
+
+// client.CheckApiKey(ctx, &domain)
+//	- check that Variomedia accepts the API key, by listing the domain's DNS records
+//	in:
+//		ctx	-	context to cancel the request
+//		domain	-	DNS domain the key is used for
+//	returns:
+//		-
+func (c *variomediaClient) CheckApiKey(ctx context.Context, domain *string) error {
+	klog.V(4).InfoS("CheckApiKey() called")
+	klog.V(5).InfoS("parameters", "domain", *domain)
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.variomediaRecordsUrl( *domain), nil)
+	if err != nil {
+		klog.ErrorS(err, "CheckApiKey() finished with error")
+		return err
+	}
+
+	// the records themselves are of no interest
+	status, _, respData, err := c.doRequest(req, false)
+	if err != nil {
+		klog.ErrorS(err, "CheckApiKey() finished with error")
+		return err
+	}
+	if status != http.StatusOK {
+		apiErr := newVariomediaApiError(status, respData)
+		klog.ErrorS(apiErr, "CheckApiKey() finished with error reported by server", "status code", status)
+		return apiErr
+	}
+
+	klog.V(4).InfoS("CheckApiKey() finished")
 	return nil
-} // func DeleteTxtRecord()
+} // func CheckApiKey()
 
+// client.Ping(ctx)
+//	- check that the API endpoint answers at all - any response but a server error will do,
+//	  as the request isn't authenticated
+//	in:
+//		ctx	-	context to cancel the request
+//	returns:
+//		-
+func (c *variomediaClient) Ping(ctx context.Context) error {
+	klog.V(4).InfoS("Ping() called")
+
+	req, err := http.NewRequestWithContext(ctx, "GET", c.baseUrl + "/", nil)
+	if err != nil {
+		klog.ErrorS(err, "Ping() finished with error")
+		return err
+	}
+
+	status, _, respData, err := c.doRequest(req, false)
+	if err != nil {
+		klog.ErrorS(err, "Ping() finished with error")
+		return err
+	}
+	if status >= http.StatusInternalServerError {
+		apiErr := newVariomediaApiError(status, respData)
+		klog.ErrorS(apiErr, "Ping() finished with error reported by server", "status code", status)
+		return apiErr
+	}
+
+	klog.V(4).InfoS("Ping() finished", "status code", status)
+	return nil
+} // func Ping()
 
 func (c *variomediaClient) variomediaRecordsUrl(domain string) string {
 	klog.V(4).InfoS("variomediaRecordsUrl() called")
 	klog.V(5).InfoS("parameters", "domain", domain)
 
-	urlpart := fmt.Sprintf("%s/dns-records", domain)
+	recordsUrl := fmt.Sprintf("%s/dns-records?filter[domain]=%s", c.baseUrl, url.QueryEscape( domain))
 
 	klog.V(4).InfoS("variomediaRecordsUrl() finished")
-	klog.V(5).InfoS("return values", "url part", urlpart)
-	return urlpart
+	klog.V(5).InfoS("return values", "url", recordsUrl)
+	return recordsUrl
+}
+
+// client.recordUrl(reply, location)
+//	- determine the URL of the record created by a request
+//	in:
+//		reply		-	the response (or, if the request started a job, the finished job)
+//		location	-	the response's Location header, if it pointed to the record
+//	returns:
+//		variomediaDNSEntryURL	-	the URL of the DNS entry, empty if unknown
+func (c *variomediaClient) recordUrl(reply variomediaResponse, location string) string {
+	if link := reply.Data.Links[ "dns-record"]; link != "" {
+		return link
+	}
+	if reply.Data.Type == "dns-record" && reply.Data.Links[ "self"] != "" {
+		return reply.Data.Links[ "self"]
+	}
+	if location != "" {
+		return location
+	}
+	if reply.Data.Type == "dns-record" && reply.Data.Id != "" {
+		return c.baseUrl + "/dns-records/" + reply.Data.Id
+	}
+	return ""
+}
+
+// client.listedRecordUrl(record)
+//	- determine the URL of a record from Variomedia's record listing
+//	in:
+//		record	-	the listed record
+//	returns:
+//		variomediaDNSEntryURL	-	the URL of the DNS entry
+func (c *variomediaClient) listedRecordUrl(record variomediaDnsRecord) string {
+	if link := record.Links[ "self"]; link != "" {
+		return link
+	}
+	return c.baseUrl + "/dns-records/" + record.Id
+}
+
+// visitRecordListPage()
+// note the visit of a page of Variomedia's record listing - a "next" link pointing back to
+// a page already visited, or too many pages, would keep us listing until the deadline
+func visitRecordListPage(visited map[string]bool, listUrl string) error {
+	if visited[ listUrl] {
+		return fmt.Errorf("failed listing DNS records: page %s was already visited", listUrl)
+	}
+	if len( visited) >= variomediaMaxRecordListPages {
+		return fmt.Errorf("failed listing DNS records: more than %d pages", variomediaMaxRecordListPages)
+	}
+	visited[ listUrl] = true
+	return nil
 }
 
-func (c *variomediaClient) doRequest(req *http.Request, readResponseBody bool) (int, []byte, error) {
+// resolveLocation()
+// make a (possibly relative) Location header absolute
+func resolveLocation(req *http.Request, location string) string {
+	if location == "" {
+		return ""
+	}
+	ref, err := url.Parse(location)
+	if err != nil {
+		return ""
+	}
+	return req.URL.ResolveReference(ref).String()
+}
+
+func (c *variomediaClient) doRequest(req *http.Request, readResponseBody bool) (_ int, _ http.Header, _ []byte, err error) {
 	klog.V(4).InfoS("doRequest() called")
-	klog.V(5).InfoS("parameters", "request", req, "readResponseBody", readResponseBody)
+	// the request itself is not logged: its headers carry the API key
+	klog.V(5).InfoS("parameters", "method", req.Method, "url", req.URL.String(), "readResponseBody", readResponseBody)
+
+	// one span per request, including retries
+	ctx, span := startSpan(req.Context(), "HTTP " + req.Method, attrHttpMethod.String(req.Method), attrHttpUrl.String(req.URL.String()))
+	defer func() {
+		endSpan(span, err)
+	}()
+	req = req.WithContext(ctx)
 
 	// Variomedia uses headers for auth, request content type and to signal accepted API versions
-	req.Header.Set("Authorization", fmt.Sprintf("token %s", c.apiKey))
+	if c.apiKey.value() != "" {
+		req.Header.Set("Authorization", fmt.Sprintf("token %s", c.apiKey.value()))
+	}
 	req.Header.Set("Content-Type", "application/vnd.api+json")
 	req.Header.Set("Accept", "application/vnd.variomedia.v1+json")
+	otel.GetTextMapPropagator().Inject(ctx, propagation.HeaderCarrier(req.Header))
+
+	var res *http.Response
+	for retries := 0; ; retries++ {
+		// stay below Variomedia's rate limit to begin with
+		if c.rateLimiter != nil {
+			if err := waitForRateLimiter(req.Context(), c.rateLimiter); err != nil {
+				klog.ErrorS(err, "doRequest() finished with error while waiting for rate limiter")
+				return 0, nil, nil, err
+			}
+		}
 
-	client := http.Client{
-		Timeout: 30 * time.Second,
+		var err error
+		start := time.Now()
+		res, err = c.httpClient.Do(req)
+		observeApiRequest(req.Method, res, start)
+		if err != nil {
+			klog.ErrorS(err, "doRequest() finished with error")
+			return 0, nil, nil, err
+		}
+		span.SetAttributes(attrHttpStatus.Int(res.StatusCode), attrRetries.Int(retries))
+
+		// have we hit the rate limit? Then retry, if Variomedia lets us within our deadline
+		if res.StatusCode != http.StatusTooManyRequests {
+			break
+		}
+		rateLimitHitsTotal.WithLabelValues(rateLimitVariomedia).Inc()
+		if retries >= maxRateLimitRetries {
+			break
+		}
+		delay, ok := rateLimitRetryDelay(req.Context(), res.Header, time.Now())
+		if !ok {
+			break
+		}
+		ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		klog.V(2).InfoS( "rate limit reached, retrying request", "url", req.URL.String(), "delay", delay, "retries", retries + 1)
+		c.event(variomediaEventRateLimited, fmt.Sprintf("Variomedia rate limit reached, retrying %s request in %v", req.Method, delay))
+
+		select {
+		case <-req.Context().Done():
+			klog.ErrorS(req.Context().Err(), "doRequest() finished with error while waiting to retry")
+			return 0, nil, nil, req.Context().Err()
+		case <-time.After(delay):
+		}
+
+		// the body was consumed by the previous attempt
+		if req.GetBody != nil {
+			req.Body, err = req.GetBody()
+			if err != nil {
+				klog.ErrorS(err, "doRequest() finished with error")
+				return 0, nil, nil, err
+			}
+		}
 	}
 
-	res, err := client.Do(req)
-	if err != nil {
-		klog.ErrorS(err, "doRequest() finished with error")
-		return 0, nil, err
+	defer res.Body.Close()
+	if res.StatusCode >= http.StatusBadRequest {
+		span.SetStatus(codes.Error, res.Status)
 	}
 
-	klog.V(5).InfoS( "HTTP request", "response", res)
+	klog.V(5).InfoS( "HTTP request", "method", req.Method, "url", req.URL.String(), "status", res.Status)
 
-	// check for proper returns
-	if (res.StatusCode == http.StatusOK || res.StatusCode == http.StatusAccepted) && readResponseBody {
-		data, err := ioutil.ReadAll(res.Body)
+	// the body is read regardless of the status code: successful responses may carry it
+	// with any 2xx code, error responses may contain a JSON:API error document
+	var data []byte
+	if readResponseBody || res.StatusCode >= http.StatusBadRequest {
+		var err error
+		data, err = ioutil.ReadAll(res.Body)
 		if err != nil {
 			klog.ErrorS(err, "HTTP request finished with error")
-			return 0, nil, err
+			return 0, nil, nil, err
 		}
-		klog.V(4).InfoS( "HTTP request succeeded", "status code", res.StatusCode)
 		klog.V(5).InfoS( "HTTP request result", "data", data)
-		return res.StatusCode, data, nil
 	}
 
-	klog.V(4).InfoS("doRequest() finished")
-	klog.V(5).InfoS("return values", "status code", res.StatusCode)
-	return res.StatusCode, nil, nil
+	klog.V(4).InfoS("doRequest() finished", "status code", res.StatusCode)
+	klog.V(5).InfoS("return values", "status code", res.StatusCode, "header", res.Header)
+	return res.StatusCode, res.Header, data, nil
 }
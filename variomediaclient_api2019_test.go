@@ -0,0 +1,281 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+func TestNewvariomediaClient_Options(t *testing.T) {
+	client := NewvariomediaClient(newVariomediaApiKey("key"))
+	assert.Equal(t, variomediaLiveApiBaseUrl, client.baseUrl)
+	assert.Equal(t, variomediaDefaultTimeout, client.httpClient.Timeout)
+
+	shared := &http.Client{Timeout: time.Minute}
+	client = NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl("http://127.0.0.1:8080/"), WithHttpClient(shared), WithTimeout(time.Second))
+	assert.Equal(t, "http://127.0.0.1:8080", client.baseUrl)
+	assert.Equal(t, time.Second, client.httpClient.Timeout)
+	assert.Equal(t, time.Minute, shared.Timeout, "shared HTTP client must not be modified")
+}
+
+func TestVariomediaClient_FindTxtRecord(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "token key", r.Header.Get("Authorization"))
+		assert.Equal(t, "/dns-records", r.URL.Path)
+		assert.Equal(t, "example.com", r.URL.Query().Get("filter[domain]"))
+		fmt.Fprintf(w, `{"data": [
+			{"type": "dns-record", "id": "1", "attributes": {"record_type": "TXT", "name": "_acme-challenge", "domain": "example.com", "data": "other", "ttl": 300}},
+			{"type": "dns-record", "id": "3", "attributes": {"record_type": "CNAME", "name": "_acme-challenge", "domain": "example.com", "data": "wanted", "ttl": 300}},
+			{"type": "dns-record", "id": "4", "attributes": {"record_type": "TXT", "name": "_acme-challenge.www", "domain": "example.com", "data": "wanted", "ttl": 300}},
+			{"type": "dns-record", "id": "5", "attributes": {"record_type": "TXT", "name": "_acme-challenge", "domain": "example.com", "data": "wanted-too", "ttl": 300}},
+			{"type": "dns-record", "id": "2", "attributes": {"record_type": "TXT", "name": "_acme-challenge", "domain": "example.com", "data": "wanted", "ttl": 300}}
+		]}`)
+	}))
+	defer server.Close()
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(server.URL), WithHttpClient(server.Client()))
+	domain, name := "example.com", "_acme-challenge"
+
+	// only a TXT record of the same name with exactly the value matches
+	value := "wanted"
+	url, err := client.FindTxtRecord(context.Background(), &domain, &name, &value)
+	assert.NoError(t, err)
+	assert.Equal(t, server.URL+"/dns-records/2", url)
+
+	value = "want"
+	url, err = client.FindTxtRecord(context.Background(), &domain, &name, &value)
+	assert.NoError(t, err)
+	assert.Empty(t, url)
+
+	value = "missing"
+	url, err = client.FindTxtRecord(context.Background(), &domain, &name, &value)
+	assert.NoError(t, err)
+	assert.Empty(t, url)
+}
+
+func TestVariomediaClient_FindTxtRecordPagination(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		domain := r.URL.Query().Get("filter[domain]")
+		page2 := fmt.Sprintf("%s/dns-records?filter[domain]=%s&page=2", server.URL, domain)
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"data": [
+				{"type": "dns-record", "id": "1", "attributes": {"record_type": "TXT", "name": "_acme-challenge", "domain": "%s", "data": "other", "ttl": 300}}
+			], "links": {"next": "%s"}}`, domain, page2)
+			return
+		}
+		// the last page of example.net links to itself
+		next := ""
+		if domain == "example.net" {
+			next = page2
+		}
+		fmt.Fprintf(w, `{"data": [
+			{"type": "dns-record", "id": "2", "attributes": {"record_type": "TXT", "name": "_acme-challenge", "domain": "%s", "data": "wanted", "ttl": 300}}
+		], "links": {"next": "%s"}}`, domain, next)
+	}))
+	defer server.Close()
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(server.URL), WithHttpClient(server.Client()))
+	domain, name, value := "example.com", "_acme-challenge", "wanted"
+
+	url, err := client.FindTxtRecord(context.Background(), &domain, &name, &value)
+	require.NoError(t, err)
+	assert.Equal(t, server.URL+"/dns-records/2", url)
+
+	domain = "example.net"
+	_, err = client.FindTxtRecord(context.Background(), &domain, &name, &value)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "already visited")
+}
+
+func TestVariomediaClient_ListTxtRecordsPageLimit(t *testing.T) {
+	requests := 0
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		requests++
+		fmt.Fprintf(w, `{"data": [], "links": {"next": "%s/dns-records?filter[domain]=example.com&page=%d"}}`, server.URL, requests+1)
+	}))
+	defer server.Close()
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(server.URL), WithHttpClient(server.Client()))
+	domain := "example.com"
+	_, err := client.ListTxtRecords(context.Background(), &domain)
+	require.Error(t, err)
+	assert.Equal(t, variomediaMaxRecordListPages, requests)
+}
+
+func TestVariomediaClient_ListTxtRecords(t *testing.T) {
+	var server *httptest.Server
+	server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		assert.Equal(t, "example.com", r.URL.Query().Get("filter[domain]"))
+		if r.URL.Query().Get("page") == "" {
+			fmt.Fprintf(w, `{"data": [
+				{"type": "dns-record", "id": "1", "attributes": {"record_type": "TXT", "name": "_acme-challenge", "domain": "example.com", "data": "first", "ttl": 300}},
+				{"type": "dns-record", "id": "2", "attributes": {"record_type": "A", "name": "www", "domain": "example.com", "data": "192.0.2.1", "ttl": 300}}
+			], "links": {"next": "%s/dns-records?filter[domain]=example.com&page=2"}}`, server.URL)
+			return
+		}
+		fmt.Fprintf(w, `{"data": [
+			{"type": "dns-record", "id": "3", "attributes": {"record_type": "TXT", "name": "_acme-challenge.www", "domain": "example.com", "data": "second", "ttl": 300},
+			 "links": {"self": "%s/dns-records/3"}},
+			{"type": "dns-record", "id": "4", "attributes": {"record_type": "TXT", "name": "_acme-challenge", "domain": "example.org", "data": "other domain", "ttl": 300}}
+		]}`, server.URL)
+	}))
+	defer server.Close()
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(server.URL), WithHttpClient(server.Client()))
+	domain := "example.com"
+	records, err := client.ListTxtRecords(context.Background(), &domain)
+	require.NoError(t, err)
+	require.Len(t, records, 2)
+	assert.Equal(t, "first", records[0].Attributes.Data)
+	assert.Equal(t, server.URL+"/dns-records/1", client.listedRecordUrl(records[0]))
+	assert.Equal(t, "_acme-challenge.www", records[1].Attributes.Name)
+	assert.Equal(t, server.URL+"/dns-records/3", client.listedRecordUrl(records[1]))
+}
+
+func TestVariomediaClient_UpdateAndDeleteTxtRecord(t *testing.T) {
+	fake := fakevariomedia.NewTest(t, "key")
+	baseUrl := fake.URL()
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(baseUrl))
+	domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+
+	url, err := client.UpdateTxtRecord(context.Background(), &domain, &name, &value, variomediaMinTtl)
+	require.NoError(t, err)
+	records := fake.Records()
+	require.Len(t, records, 1)
+	assert.Equal(t, baseUrl+"/dns-records/"+records[0].Id, url)
+	assert.Equal(t, fakevariomedia.Record{Id: records[0].Id, RecordType: "TXT", Name: name, Domain: domain, Data: value, Ttl: variomediaMinTtl}, records[0])
+
+	found, err := client.FindTxtRecord(context.Background(), &domain, &name, &value)
+	require.NoError(t, err)
+	assert.Equal(t, url, found)
+
+	require.NoError(t, client.DeleteTxtRecord(context.Background(), url))
+	assert.Empty(t, fake.Records())
+
+	// deleting a record that is already gone is fine
+	assert.NoError(t, client.DeleteTxtRecord(context.Background(), url))
+}
+
+func TestVariomediaClient_WrongApiKey(t *testing.T) {
+	fake := fakevariomedia.NewTest(t, "key")
+	baseUrl := fake.URL()
+
+	client := NewvariomediaClient(newVariomediaApiKey("wrong"), WithBaseUrl(baseUrl))
+	domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+
+	_, err := client.UpdateTxtRecord(context.Background(), &domain, &name, &value, variomediaMinTtl)
+	assert.Error(t, err)
+	assert.Empty(t, fake.Records())
+}
+
+func TestVariomediaClient_Cancel(t *testing.T) {
+	fake := fakevariomedia.NewTest(t, "key")
+	fake.PendingPolls = 100
+	baseUrl := fake.URL()
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(baseUrl))
+	domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	_, err := client.UpdateTxtRecord(ctx, &domain, &name, &value, variomediaMinTtl)
+	assert.Error(t, err)
+	assert.Less(t, int64(time.Since(start)), int64(defaultJobPollDelay), "waiting for the job was not aborted")
+}
+
+// serveApiResponse returns a handler answering with a recorded response from
+// testdata/api-responses, with "{{base}}" replaced by the test server's URL.
+func serveApiResponse(t *testing.T, base *string, status int, location, fixture string) http.HandlerFunc {
+	var body []byte
+	if fixture != "" {
+		var err error
+		body, err = os.ReadFile(filepath.Join("testdata", "api-responses", fixture))
+		require.NoError(t, err)
+	}
+	return func(w http.ResponseWriter, r *http.Request) {
+		if location != "" {
+			w.Header().Set("Location", location)
+		}
+		w.WriteHeader(status)
+		w.Write([]byte(strings.ReplaceAll(string(body), "{{base}}", *base)))
+	}
+}
+
+func TestVariomediaClient_UpdateTxtRecordResponses(t *testing.T) {
+	tests := []struct {
+		name     string
+		status   int
+		location string
+		fixture  string
+		want     string
+	}{
+		{name: "202 with pending job", status: http.StatusAccepted, fixture: "job-pending-202.json", want: "/dns-records/42"},
+		{name: "202 with finished job", status: http.StatusAccepted, fixture: "job-done.json", want: "/dns-records/42"},
+		{name: "200 with finished job", status: http.StatusOK, fixture: "job-done.json", want: "/dns-records/42"},
+		{name: "200 with job without record link", status: http.StatusOK, location: "/dns-records/43", fixture: "job-done-without-record.json", want: "/dns-records/43"},
+		{name: "202 with job without record link", status: http.StatusAccepted, location: "/dns-records/43", fixture: "job-done-without-record.json", want: "/dns-records/43"},
+		{name: "202 with pending job and location", status: http.StatusAccepted, location: "/dns-records/43", fixture: "job-pending-202.json", want: "/dns-records/42"},
+		{name: "201 with record", status: http.StatusCreated, location: "/dns-records/43", fixture: "record-201.json", want: "/dns-records/42"},
+		{name: "201 with record without links", status: http.StatusCreated, fixture: "record-without-links-201.json", want: "/dns-records/42"},
+		{name: "201 without body", status: http.StatusCreated, location: "/dns-records/43", want: "/dns-records/43"},
+		{name: "201 with job without record link", status: http.StatusCreated, location: "/dns-records/43", fixture: "job-done-without-record.json", want: "/dns-records/43"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var base string
+			mux := http.NewServeMux()
+			mux.Handle("/dns-records", serveApiResponse(t, &base, tt.status, tt.location, tt.fixture))
+			mux.Handle("/queue-jobs/17", serveApiResponse(t, &base, http.StatusOK, "", "job-done.json"))
+			server := httptest.NewServer(mux)
+			defer server.Close()
+			base = server.URL
+
+			client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(server.URL), WithHttpClient(server.Client()),
+				WithJobWaiter(variomediaJobWaiter{InitialDelay: 10 * time.Millisecond, Deadline: 5 * time.Second}))
+			domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+
+			url, err := client.UpdateTxtRecord(context.Background(), &domain, &name, &value, variomediaMinTtl)
+			require.NoError(t, err)
+			assert.Equal(t, server.URL+tt.want, url)
+		})
+	}
+}
+
+func TestVariomediaClient_UpdateTxtRecordWithoutRecordUrl(t *testing.T) {
+	var base string
+	server := httptest.NewServer(serveApiResponse(t, &base, http.StatusCreated, "", ""))
+	defer server.Close()
+	base = server.URL
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(server.URL), WithHttpClient(server.Client()))
+	domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+
+	_, err := client.UpdateTxtRecord(context.Background(), &domain, &name, &value, variomediaMinTtl)
+	require.Error(t, err)
+	assert.Contains(t, err.Error(), "contains no record URL")
+}
+
+func TestVariomediaClient_DeleteTxtRecordNoContent(t *testing.T) {
+	var base string
+	server := httptest.NewServer(serveApiResponse(t, &base, http.StatusNoContent, "", ""))
+	defer server.Close()
+	base = server.URL
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(server.URL), WithHttpClient(server.Client()))
+	assert.NoError(t, client.DeleteTxtRecord(context.Background(), server.URL+"/dns-records/42"))
+}
@@ -0,0 +1,107 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// errors reported by the Variomedia API
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+// variomediaErrorObject is a single entry of the "errors" array of a JSON:API error document
+type variomediaErrorObject struct {
+	Status string `json:"status"`
+	Code   string `json:"code"`
+	Title  string `json:"title"`
+	Detail string `json:"detail"`
+	Source struct {
+		Pointer   string `json:"pointer"`
+		Parameter string `json:"parameter"`
+	} `json:"source"`
+} // variomediaErrorObject
+
+type variomediaErrorDocument struct {
+	Errors []variomediaErrorObject `json:"errors"`
+} // variomediaErrorDocument
+
+// variomediaApiError is returned for requests answered by Variomedia with an error status
+type variomediaApiError struct {
+	StatusCode int
+	Errors     []variomediaErrorObject
+} // variomediaApiError
+
+// newVariomediaApiError()
+// create the error for the given HTTP status, with the details from the response body
+// if it contains a JSON:API error document
+func newVariomediaApiError(statusCode int, body []byte) *variomediaApiError {
+	apiErr := &variomediaApiError{StatusCode: statusCode}
+	var doc variomediaErrorDocument
+	if len(body) > 0 && json.Unmarshal(body, &doc) == nil {
+		apiErr.Errors = doc.Errors
+	}
+	return apiErr
+}
+
+func (e *variomediaApiError) Error() string {
+	if len(e.Errors) == 0 {
+		return fmt.Sprintf("Variomedia reported HTTP status %d (%s)", e.StatusCode, http.StatusText(e.StatusCode))
+	}
+
+	details := make([]string, 0, len(e.Errors))
+	for _, obj := range e.Errors {
+		detail := obj.Title
+		if obj.Code != "" {
+			detail = fmt.Sprintf("%s (%s)", detail, obj.Code)
+		}
+		if obj.Detail != "" {
+			detail = fmt.Sprintf("%s: %s", detail, obj.Detail)
+		}
+		if obj.Source.Pointer != "" {
+			detail = fmt.Sprintf("%s [%s]", detail, obj.Source.Pointer)
+		} else if obj.Source.Parameter != "" {
+			detail = fmt.Sprintf("%s [parameter %s]", detail, obj.Source.Parameter)
+		}
+		details = append(details, strings.TrimSpace(detail))
+	}
+	return fmt.Sprintf("Variomedia reported HTTP status %d: %s", e.StatusCode, strings.Join(details, "; "))
+}
+
+// IsAuth reports whether the API key was rejected
+func (e *variomediaApiError) IsAuth() bool {
+	return e.StatusCode == http.StatusUnauthorized || e.StatusCode == http.StatusForbidden
+}
+
+// IsValidation reports whether Variomedia rejected the request's content, i.e. a TTL
+// below variomediaMinTtl
+func (e *variomediaApiError) IsValidation() bool {
+	return e.StatusCode == http.StatusBadRequest || e.StatusCode == http.StatusUnprocessableEntity
+}
+
+// IsNotFound reports whether the addressed resource, i.e. a domain or record, does not exist
+func (e *variomediaApiError) IsNotFound() bool {
+	return e.StatusCode == http.StatusNotFound
+}
+
+// IsRateLimited reports whether Variomedia's rate limit was reached
+func (e *variomediaApiError) IsRateLimited() bool {
+	return e.StatusCode == http.StatusTooManyRequests
+}
+
+// IsTransient reports whether retrying the request later may succeed
+func (e *variomediaApiError) IsTransient() bool {
+	return e.IsRateLimited() || e.StatusCode >= http.StatusInternalServerError
+}
+
+// isVariomediaApiError()
+// check whether err (or any error it wraps) is a Variomedia API error matching the given
+// predicate, i.e. isVariomediaApiError(err, (*variomediaApiError).IsAuth)
+func isVariomediaApiError(err error, predicate func(*variomediaApiError) bool) bool {
+	var apiErr *variomediaApiError
+	return errors.As(err, &apiErr) && predicate(apiErr)
+}
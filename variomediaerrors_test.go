@@ -0,0 +1,77 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+func TestNewVariomediaApiError(t *testing.T) {
+	body := []byte(`{"errors": [
+		{"status": "422", "code": "invalid-ttl", "title": "Invalid attribute", "detail": "ttl must be at least 300", "source": {"pointer": "/data/attributes/ttl"}},
+		{"status": "422", "title": "Invalid parameter", "source": {"parameter": "filter[domain]"}}
+	]}`)
+	apiErr := newVariomediaApiError(http.StatusUnprocessableEntity, body)
+	assert.Len(t, apiErr.Errors, 2)
+	assert.Equal(t, "/data/attributes/ttl", apiErr.Errors[0].Source.Pointer)
+	assert.EqualError(t, apiErr, "Variomedia reported HTTP status 422: Invalid attribute (invalid-ttl): ttl must be at least 300 [/data/attributes/ttl]; Invalid parameter [parameter filter[domain]]")
+
+	// no (or no valid) error document
+	assert.EqualError(t, newVariomediaApiError(http.StatusBadGateway, nil), "Variomedia reported HTTP status 502 (Bad Gateway)")
+	assert.EqualError(t, newVariomediaApiError(http.StatusBadGateway, []byte("<html>")), "Variomedia reported HTTP status 502 (Bad Gateway)")
+}
+
+func TestVariomediaApiError_Classification(t *testing.T) {
+	tests := []struct {
+		status                                             int
+		auth, validation, notFound, rateLimited, transient bool
+	}{
+		{http.StatusBadRequest, false, true, false, false, false},
+		{http.StatusUnauthorized, true, false, false, false, false},
+		{http.StatusForbidden, true, false, false, false, false},
+		{http.StatusNotFound, false, false, true, false, false},
+		{http.StatusUnprocessableEntity, false, true, false, false, false},
+		{http.StatusTooManyRequests, false, false, false, true, true},
+		{http.StatusServiceUnavailable, false, false, false, false, true},
+	}
+	for _, test := range tests {
+		// callers see the error wrapped
+		err := fmt.Errorf("failed creating TXT record: %w", newVariomediaApiError(test.status, nil))
+		assert.Equal(t, test.auth, isVariomediaApiError(err, (*variomediaApiError).IsAuth), "status %d", test.status)
+		assert.Equal(t, test.validation, isVariomediaApiError(err, (*variomediaApiError).IsValidation), "status %d", test.status)
+		assert.Equal(t, test.notFound, isVariomediaApiError(err, (*variomediaApiError).IsNotFound), "status %d", test.status)
+		assert.Equal(t, test.rateLimited, isVariomediaApiError(err, (*variomediaApiError).IsRateLimited), "status %d", test.status)
+		assert.Equal(t, test.transient, isVariomediaApiError(err, (*variomediaApiError).IsTransient), "status %d", test.status)
+	}
+	assert.False(t, isVariomediaApiError(fmt.Errorf("some other error"), (*variomediaApiError).IsAuth))
+}
+
+func TestVariomediaClient_ApiErrors(t *testing.T) {
+	fake := fakevariomedia.NewTest(t, "key")
+	baseUrl := fake.URL()
+	domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+
+	client := NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(baseUrl))
+	_, err := client.UpdateTxtRecord(context.Background(), &domain, &name, &value, 60)
+	assert.True(t, isVariomediaApiError(err, (*variomediaApiError).IsValidation))
+	assert.Contains(t, err.Error(), "ttl must be at least 300")
+
+	client = NewvariomediaClient(newVariomediaApiKey("wrong"), WithBaseUrl(baseUrl))
+	_, err = client.FindTxtRecord(context.Background(), &domain, &name, &value)
+	assert.True(t, isVariomediaApiError(err, (*variomediaApiError).IsAuth))
+	assert.Contains(t, err.Error(), "missing or invalid API token")
+}
+
+func TestExplainVariomediaError(t *testing.T) {
+	err := explainVariomediaError(fmt.Errorf("failed creating TXT record: %w", newVariomediaApiError(http.StatusUnauthorized, nil)), "example.com")
+	assert.EqualError(t, err, "API key configured for domain 'example.com' was rejected: failed creating TXT record: Variomedia reported HTTP status 401 (Unauthorized)")
+	assert.True(t, isVariomediaApiError(err, (*variomediaApiError).IsAuth), "explained error must still wrap the API error")
+
+	other := fmt.Errorf("some other error")
+	assert.Equal(t, other, explainVariomediaError(other, "example.com"))
+}
@@ -0,0 +1,257 @@
+// cert-manager webhook supporting Variomedia (https://api.variomedia.de)
+//
+// waiting for Variomedia's queued DNS jobs
+//
+// Licensed under Apache License 2.0 (see https://directory.fsf.org/wiki/License:Apache-2.0)
+
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"math/rand"
+	"net/http"
+	"strings"
+	"time"
+
+	"k8s.io/klog/v2"
+)
+
+// terminal and non-terminal states of Variomedia's queue jobs
+const (
+	variomediaJobPending = "pending"
+	variomediaJobDone    = "done"
+	variomediaJobFailed  = "failed"
+)
+
+// default backoff settings when waiting for queue jobs
+const (
+	defaultJobPollDelay      = 2 * time.Second
+	defaultJobPollMaxDelay   = 15 * time.Second
+	defaultJobPollMultiplier = 1.5
+	defaultJobPollJitter     = 0.2
+	// together with defaultPropagationTimeout, leaves 10s of defaultChallengeTimeout for
+	// the API requests themselves
+	defaultJobDeadline = 30 * time.Second
+)
+
+// variomediaJobWaiter follows the "queue-job" link of a Variomedia job until the job
+// reaches a terminal state, with exponential backoff between the status lookups
+type variomediaJobWaiter struct {
+	InitialDelay time.Duration // delay before the first status lookup
+	MaxDelay     time.Duration // upper limit for the delay between status lookups
+	Multiplier   float64       // factor to increase the delay by after each lookup
+	Jitter       float64       // random variation of each delay, as fraction (0.2 = +/-20%)
+	Deadline     time.Duration // overall time the job may take, 0 for no limit
+} // variomediaJobWaiter
+
+// defaultJobWaiter()
+//	- waiter settings used unless configured otherwise
+//	returns:
+//		waiter	-	the default settings
+func defaultJobWaiter() variomediaJobWaiter {
+	return variomediaJobWaiter{
+		InitialDelay: defaultJobPollDelay,
+		MaxDelay:     defaultJobPollMaxDelay,
+		Multiplier:   defaultJobPollMultiplier,
+		Jitter:       defaultJobPollJitter,
+		Deadline:     defaultJobDeadline,
+	}
+}
+
+// variomediaJobState(status)
+//	- map the status reported by Variomedia to our job state model - anything we
+//	  don't know (yet) is considered to be still in progress
+//	in:
+//		status	-	the job status reported by Variomedia
+//	returns:
+//		state	-	variomediaJobPending, variomediaJobDone or variomediaJobFailed
+func variomediaJobState(status string) string {
+	switch strings.ToLower(status) {
+	case "done":
+		return variomediaJobDone
+	case "failed", "error", "aborted", "canceled", "cancelled":
+		return variomediaJobFailed
+	default:
+		return variomediaJobPending
+	}
+}
+
+// isVariomediaJob(reply)
+//	- check whether a response reports a queue job (rather than i.e. the record itself)
+//	in:
+//		reply	-	the decoded response
+//	returns:
+//		true if the response reports a job
+func isVariomediaJob(reply variomediaResponse) bool {
+	return reply.Data.Type == "queue-job" || reply.Data.Attributes["status"] != ""
+}
+
+// waiter.wait(ctx, client, job, operation, goneIsDone)
+//	- wait for a queue job to finish
+//	in:
+//		ctx		-	context to cancel waiting
+//		client		-	Variomedia client to look up the job status with
+//		job		-	the response that reported the job
+//		operation	-	description of the operation for error messages, i.e. "creating TXT record"
+//		goneIsDone	-	treat a vanished job or record (HTTP status 404) as finished
+//	returns:
+//		job		-	the most recent job status
+func (w variomediaJobWaiter) wait(ctx context.Context, c *variomediaClient, job variomediaResponse, operation string, goneIsDone bool) (_ variomediaResponse, err error) {
+	klog.V(4).InfoS("wait() called")
+	klog.V(5).InfoS("parameters", "job", job, "operation", operation, "goneIsDone", goneIsDone)
+
+	start := time.Now()
+	defer func() {
+		jobWaitDuration.WithLabelValues(outcome(err)).Observe(time.Since(start).Seconds())
+	}()
+
+	if w.Deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, w.Deadline)
+		defer cancel()
+	}
+
+	delay := w.InitialDelay
+	for lookups := 0; ; lookups++ {
+		status := job.Data.Attributes["status"]
+		switch variomediaJobState(status) {
+		case variomediaJobDone:
+			klog.V(2).InfoS("DNS job finished", "operation", operation, "job", job.Data.Id, "status lookups", lookups)
+			return job, nil
+		case variomediaJobFailed:
+			klog.ErrorS(nil, "wait() finished with error: job failed", "operation", operation, "job", job.Data.Id, "status", status)
+			return job, fmt.Errorf("failed %s: DNS job reported status '%s'", operation, status)
+		}
+		klog.V(2).InfoS("DNS job still pending", "operation", operation, "job", job.Data.Id, "status", status, "next lookup in", delay)
+		c.event(variomediaEventJobPending, fmt.Sprintf("Variomedia DNS job %s for %s is still pending", job.Data.Id, operation))
+
+		jobUrl := job.Data.Links["queue-job"]
+		if jobUrl == "" {
+			klog.ErrorS(nil, "wait() finished with error: job has no queue-job link", "operation", operation, "job", job.Data.Id)
+			return job, fmt.Errorf("failed %s: DNS job with status '%s' has no queue-job link", operation, status)
+		}
+
+		// inter-loop delay, then re-fetch the job status
+		next, err := w.poll(ctx, c, job, jobUrl, delay, lookups+1)
+		delay = w.nextDelay(delay)
+		switch {
+		case err == nil:
+			job = next
+		case goneIsDone && isVariomediaApiError(err, (*variomediaApiError).IsNotFound):
+			// 404 means the job (and the record it was about) is gone
+			klog.V(2).InfoS("DNS job finished, job is gone", "operation", operation, "status lookups", lookups+1)
+			return job, nil
+		case ctx.Err() != nil:
+			klog.ErrorS(err, "wait() finished with error: job timed out", "operation", operation, "most recent status", status)
+			return job, fmt.Errorf("failed %s: DNS job timed out with most recent status '%s'", operation, status)
+		default:
+			klog.ErrorS(err, "wait() finished with error")
+			return job, fmt.Errorf("failed %s: %w", operation, err)
+		}
+	}
+} // func wait()
+
+// waiter.poll(ctx, client, job, jobUrl, delay, lookup)
+//	- wait for the delay, then look up the job status once - traced as one span, so
+//	  traces show the time spent per poll
+//	in:
+//		ctx		-	context to cancel waiting and the lookup
+//		client		-	Variomedia client to look up the job status with
+//		job		-	the most recent job status
+//		jobUrl		-	URL to look up the job status at
+//		delay		-	delay before the lookup, without jitter
+//		lookup		-	number of the lookup, starting with 1
+//	returns:
+//		job		-	the job status looked up
+func (w variomediaJobWaiter) poll(ctx context.Context, c *variomediaClient, job variomediaResponse, jobUrl string, delay time.Duration, lookup int) (_ variomediaResponse, err error) {
+	ctx, span := startSpan(ctx, "poll DNS job", attrJobId.String(job.Data.Id), attrJobLookup.Int(lookup))
+	defer func() {
+		endSpan(span, err)
+	}()
+
+	select {
+	case <-ctx.Done():
+		return job, ctx.Err()
+	case <-time.After(w.jittered(delay)):
+	}
+
+	next, err := c.lookupJob(ctx, jobUrl)
+	if err != nil {
+		return job, err
+	}
+	span.SetAttributes(attrJobStatus.String(next.Data.Attributes["status"]))
+	return next, nil
+}
+
+// waiter.jittered(delay)
+//	- randomize the delay by the configured jitter
+//	in:
+//		delay	-	the delay to randomize
+//	returns:
+//		the randomized delay
+func (w variomediaJobWaiter) jittered(delay time.Duration) time.Duration {
+	if w.Jitter <= 0 {
+		return delay
+	}
+	return time.Duration(float64(delay) * (1 + w.Jitter*(2*rand.Float64()-1)))
+}
+
+// waiter.nextDelay(delay)
+//	- increase the delay by the configured multiplier, up to the configured maximum
+//	in:
+//		delay	-	the delay before the previous lookup
+//	returns:
+//		the delay before the next lookup
+func (w variomediaJobWaiter) nextDelay(delay time.Duration) time.Duration {
+	if w.Multiplier > 1 {
+		delay = time.Duration(float64(delay) * w.Multiplier)
+	}
+	if w.MaxDelay > 0 && delay > w.MaxDelay {
+		delay = w.MaxDelay
+	}
+	return delay
+}
+
+// client.lookupJob(ctx, url)
+//	- fetch the current status of a queue job
+//	in:
+//		ctx	-	context to cancel the request
+//		url	-	the job's "queue-job" link
+//	returns:
+//		job	-	the decoded reply
+func (c *variomediaClient) lookupJob(ctx context.Context, url string) (variomediaResponse, error) {
+	klog.V(4).InfoS("lookupJob() called")
+	klog.V(5).InfoS("parameters", "url", url)
+
+	var reply variomediaResponse
+	req, err := http.NewRequestWithContext(ctx, "GET", url, nil)
+	if err != nil {
+		klog.ErrorS(err, "lookupJob() finished with error")
+		return reply, err
+	}
+
+	// contact Variomedia and check the results
+	status, _, respData, err := c.doRequest(req, true)
+	if err != nil {
+		klog.ErrorS(err, "lookupJob() finished with error")
+		return reply, err
+	}
+
+	if status != http.StatusCreated && status != http.StatusOK && status != http.StatusAccepted {
+		apiErr := newVariomediaApiError(status, respData)
+		klog.ErrorS(apiErr, "lookupJob() finished with error reported by server", "status code", status)
+		return reply, apiErr
+	}
+
+	err = json.Unmarshal(respData, &reply)
+	if err != nil {
+		klog.ErrorS(err, "lookupJob() finished with error")
+		return reply, fmt.Errorf("cannot unmarshall response to json: %v", err)
+	}
+	klog.V(5).InfoS("HTTP finished", "JSON reply", reply)
+
+	klog.V(4).InfoS("lookupJob() finished")
+	return reply, nil
+} // func lookupJob()
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/stretchr/testify/require"
+
+	"github.com/jmozd/cert-manager-webhook-variomedia/fakevariomedia"
+)
+
+func TestVariomediaJobState(t *testing.T) {
+	assert.Equal(t, variomediaJobDone, variomediaJobState("done"))
+	assert.Equal(t, variomediaJobFailed, variomediaJobState("failed"))
+	assert.Equal(t, variomediaJobFailed, variomediaJobState("Error"))
+	assert.Equal(t, variomediaJobPending, variomediaJobState("pending"))
+	assert.Equal(t, variomediaJobPending, variomediaJobState("running"))
+	assert.Equal(t, variomediaJobPending, variomediaJobState(""))
+}
+
+func TestVariomediaJobWaiter_Backoff(t *testing.T) {
+	w := variomediaJobWaiter{InitialDelay: time.Second, MaxDelay: 3 * time.Second, Multiplier: 2, Jitter: 0.5}
+
+	assert.Equal(t, 2*time.Second, w.nextDelay(time.Second))
+	assert.Equal(t, 3*time.Second, w.nextDelay(2*time.Second))
+	assert.Equal(t, 3*time.Second, w.nextDelay(3*time.Second))
+	for i := 0; i < 100; i++ {
+		delay := w.jittered(time.Second)
+		assert.GreaterOrEqual(t, int64(delay), int64(500*time.Millisecond))
+		assert.LessOrEqual(t, int64(delay), int64(1500*time.Millisecond))
+	}
+
+	w.Jitter = 0
+	assert.Equal(t, time.Second, w.jittered(time.Second))
+}
+
+func newWaiterTestClient(fake *fakevariomedia.Server, w variomediaJobWaiter) *variomediaClient {
+	return NewvariomediaClient(newVariomediaApiKey("key"), WithBaseUrl(fake.URL()), WithJobWaiter(w))
+}
+
+func TestVariomediaJobWaiter_Wait(t *testing.T) {
+	fake := fakevariomedia.NewTest(t, "key")
+	fake.PendingPolls = 3
+	client := newWaiterTestClient(fake, variomediaJobWaiter{InitialDelay: 10 * time.Millisecond, Multiplier: 2, Deadline: 5 * time.Second})
+	domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+
+	url, err := client.UpdateTxtRecord(context.Background(), &domain, &name, &value, variomediaMinTtl)
+	require.NoError(t, err)
+	assert.NotEmpty(t, url)
+	assert.Len(t, fake.Records(), 1)
+
+	require.NoError(t, client.DeleteTxtRecord(context.Background(), url))
+	assert.Empty(t, fake.Records())
+}
+
+func TestVariomediaJobWaiter_Failed(t *testing.T) {
+	fake := fakevariomedia.NewTest(t, "key")
+	fake.PendingPolls = 1
+	fake.FailJobs = true
+	client := newWaiterTestClient(fake, variomediaJobWaiter{InitialDelay: 10 * time.Millisecond})
+	domain, name, value := "example.com", "_acme-challenge", "challenge-key"
+
+	_, err := client.UpdateTxtRecord(context.Background(), &domain, &name, &value, variomediaMinTtl)
+	assert.EqualError(t, err, "failed creating TXT record: DNS job reported status 'failed'")
+	assert.Empty(t, fake.Records())
+}
+
+func TestVariomediaJobWaiter_Deadline(t *testing.T) {
+	fake := fakevariomedia.NewTest(t, "key")
+	fake.PendingPolls = 1000
+	client := newWaiterTestClient(fake, variomediaJobWaiter{InitialDelay: 10 * time.Millisecond, Deadline: 100 * time.Millisecond})
+	id := fake.AddRecord(fakevariomedia.Record{RecordType: "TXT", Name: "_acme-challenge", Domain: "example.com", Data: "key", Ttl: 300})
+
+	start := time.Now()
+	err := client.DeleteTxtRecord(context.Background(), fake.URL()+"/dns-records/"+id)
+	assert.EqualError(t, err, "failed deleting TXT record: DNS job timed out with most recent status 'pending'")
+	assert.Less(t, int64(time.Since(start)), int64(time.Second))
+}